@@ -0,0 +1,223 @@
+//   Copyright 2019 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	pongo "github.com/flosch/pongo2"
+	"github.com/gorilla/mux"
+)
+
+// When the dictionaries miss a mention of a drug or disease, reviewers can add it themselves.
+// This makes the same pair of items the annotation query reads: an anchor saying where in the
+// article the mention is, and an annotation saying what term it is.
+
+const MAX_PHRASE_LENGTH = 200
+
+type newAnnotation struct {
+	Term            string
+	Dictionary      string
+	WikidataID      string
+	Offset          string
+	PrecedingPhrase string
+	FollowingPhrase string
+}
+
+func newAnnotationFromForm(r *http.Request) newAnnotation {
+	return newAnnotation{
+		Term:            strings.TrimSpace(r.FormValue("term")),
+		Dictionary:      strings.TrimSpace(r.FormValue("dictionary")),
+		WikidataID:      strings.TrimSpace(r.FormValue("wikidataid")),
+		Offset:          strings.TrimSpace(r.FormValue("offset")),
+		PrecedingPhrase: strings.TrimSpace(r.FormValue("preceding_phrase")),
+		FollowingPhrase: strings.TrimSpace(r.FormValue("following_phrase")),
+	}
+}
+
+// Returns a list of problems with the new annotation for the reviewer to fix, which is empty if
+// it's good to go
+func (a newAnnotation) Validate(annotations []*AnnotationInfo) []string {
+
+	problems := make([]string, 0)
+	if a.Term == "" {
+		problems = append(problems, "Please give the term that is mentioned.")
+	}
+	if a.Dictionary == "" {
+		problems = append(problems, "Please say which dictionary the term belongs to.")
+	}
+	if !WIKIDATA_ID_PATTERN.MatchString(a.WikidataID) {
+		problems = append(problems, "The Wikidata item should be a Q number, such as Q12345.")
+	}
+	offset, err := strconv.Atoi(a.Offset)
+	if err != nil || offset < 0 {
+		problems = append(problems, "The character offset should be a whole number, counting from zero at the start of the article.")
+	}
+	if len(a.PrecedingPhrase) > MAX_PHRASE_LENGTH || len(a.FollowingPhrase) > MAX_PHRASE_LENGTH {
+		problems = append(problems, fmt.Sprintf("Please keep the surrounding phrases to %d characters or fewer.", MAX_PHRASE_LENGTH))
+	}
+
+	if err == nil {
+		for _, annotation := range annotations {
+			existing, ok := annotationOffset(annotation)
+			if ok && int(existing) == offset && (strings.EqualFold(annotation.Term, a.Term) || annotation.WikidataID == a.WikidataID) {
+				problems = append(problems, fmt.Sprintf("There is already an annotation for %s at character %d.", annotation.Term, offset))
+				break
+			}
+		}
+	}
+
+	return problems
+}
+
+// Makes the anchor and then the annotation based on it. If the second fails we're left with an
+// anchor that nothing refers to, which is harmless but worth knowing about, so we say so, and the
+// audit log entry lists it.
+func (cw *claimWriter) CreateAnnotation(article_title string, a newAnnotation) (string, error) {
+
+	var annotation_id string
+	err := cw.audited("create_annotation", nil, func() error {
+
+		article_id := cw.article
+
+		properties := cw.ctx.Configuration.PropertyMap
+		offset, err := strconv.Atoi(a.Offset)
+		if err != nil {
+			return err
+		}
+
+		anchor_in, err := itemSnak(properties["anchorin"], article_id)
+		if err != nil {
+			return err
+		}
+		anchor_statements := []wikibaseStatement{
+			newStatement(anchor_in),
+			newStatement(quantitySnak(properties["offset"], offset)),
+		}
+		if a.PrecedingPhrase != "" {
+			anchor_statements = append(anchor_statements, newStatement(stringSnak(properties["preceding_phrase"], a.PrecedingPhrase)))
+		}
+		if a.FollowingPhrase != "" {
+			anchor_statements = append(anchor_statements, newStatement(stringSnak(properties["following_phrase"], a.FollowingPhrase)))
+		}
+
+		anchor_label := fmt.Sprintf("%s at character %d of %s", a.Term, offset, article_title)
+		anchor_id, err := cw.createItem("create_anchor", anchor_label, cw.editSummary("Added anchor", a.Term), anchor_statements)
+		if err != nil {
+			return err
+		}
+
+		based_on, err := itemSnak(properties["basedon"], anchor_id)
+		if err != nil {
+			return err
+		}
+		annotation_statements := []wikibaseStatement{
+			newStatement(based_on),
+			newStatement(stringSnak(properties["term"], a.Term)),
+			newStatement(stringSnak(properties["dictionary"], a.Dictionary)),
+			newStatement(stringSnak(properties["wikidataid"], a.WikidataID)),
+		}
+
+		annotation_id, err = cw.createItem("create_annotation", a.Term, cw.editSummary("Added annotation", a.Term), annotation_statements)
+		if err != nil {
+			cw.ctx.Log("error", "Created anchor but failed to create its annotation", logFields{"anchor": anchor_id, "error": err})
+			return err
+		}
+
+		cw.ctx.Log("info", "Created annotation", logFields{"article": article_id, "anchor": anchor_id, "annotation": annotation_id})
+		return nil
+	})
+	return annotation_id, err
+}
+
+func annotateHandler(ctx *ServerContext, w http.ResponseWriter, r *http.Request) {
+
+	// Should only be called by POST
+	if r.Method != "POST" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		ctx.renderError(w, badRequestError("We couldn't read the submitted form.", err))
+		return
+	}
+	confirm := r.FormValue("confirm")
+	annotation := newAnnotationFromForm(r)
+
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	article, annotations, _, err := ctx.getArticleAndAnnotations(id)
+	if err != nil {
+		ctx.renderError(w, err)
+		return
+	}
+
+	// Coming from the article page there's nothing to check yet
+	problems := make([]string, 0)
+	if annotation != (newAnnotation{}) {
+		problems = annotation.Validate(annotations)
+	}
+
+	if confirm == "true" && annotation != (newAnnotation{}) && len(problems) == 0 {
+		if ctx.AccessToken == nil {
+			ctx.renderError(w, unauthorisedError("You must be logged in to add an annotation.", nil))
+			return
+		}
+		err = ctx.checkCSRF(r)
+		if err != nil {
+			ctx.renderError(w, err)
+			return
+		}
+
+		_, err = ctx.newClaimWriter(id).CreateAnnotation(article.Title, annotation)
+		if err != nil {
+			ctx.renderError(w, err)
+			return
+		}
+
+		http.Redirect(w, r, "../", http.StatusSeeOther)
+		return
+	}
+
+	// Offer the dictionaries already used in this article, as new annotations should match them
+	dictionary_set := make(map[string]bool, 0)
+	for _, a := range annotations {
+		dictionary_set[a.Dictionary] = true
+	}
+	dictionaries := make([]string, 0, len(dictionary_set))
+	for dictionary := range dictionary_set {
+		dictionaries = append(dictionaries, dictionary)
+	}
+	sort.Strings(dictionaries)
+
+	err = ctx.Templates.ExecuteWriter("annotate.html", pongo.Context{
+		"title":        article.Title,
+		"annotation":   annotation,
+		"problems":     problems,
+		"dictionaries": dictionaries,
+		"max_length":   MAX_PHRASE_LENGTH,
+		"ctx":          ctx,
+	}, w)
+	if err != nil {
+		ctx.renderError(w, err)
+	}
+}
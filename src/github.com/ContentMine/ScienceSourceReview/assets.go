@@ -0,0 +1,180 @@
+//   Copyright 2019 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The templates and static files are built into the binary so it can be run from anywhere.
+//
+//go:embed templates static
+var embeddedAssets embed.FS
+
+const STATIC_URL_PREFIX = "/static/"
+
+// Content hashed URLs never change content, so can be cached for as long as browsers allow.
+// Anything requested by its plain name, such as the logo referenced from the CSS, may change
+// when we're upgraded so is only cached briefly.
+const STATIC_HASHED_CACHE_CONTROL = "public, max-age=31536000, immutable"
+const STATIC_PLAIN_CACHE_CONTROL = "public, max-age=300"
+
+// Embedded files have no modification time, so we use when we started for Last-Modified
+var startTime = time.Now()
+
+// Looks for files in the override first, falling back to the base. This lets a deployment
+// replace individual templates or static files with its own without rebuilding.
+type overlayFS struct {
+	Override fs.FS
+	Base     fs.FS
+}
+
+func (o overlayFS) Open(name string) (fs.File, error) {
+	if o.Override != nil {
+		f, err := o.Override.Open(name)
+		if err == nil {
+			return f, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+	return o.Base.Open(name)
+}
+
+func (o overlayFS) ReadDir(name string) ([]fs.DirEntry, error) {
+
+	entries := make(map[string]fs.DirEntry, 0)
+
+	base, err := fs.ReadDir(o.Base, name)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	for _, entry := range base {
+		entries[entry.Name()] = entry
+	}
+
+	if o.Override != nil {
+		override, err := fs.ReadDir(o.Override, name)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		for _, entry := range override {
+			entries[entry.Name()] = entry
+		}
+	}
+
+	res := make([]fs.DirEntry, 0, len(entries))
+	for _, entry := range entries {
+		res = append(res, entry)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name() < res[j].Name() })
+	return res, nil
+}
+
+// Returns the file system for one of the embedded asset directories, with the same directory
+// under theme_dir layered on top if one is configured.
+func assetFS(theme_dir string, dir string) (fs.FS, error) {
+
+	base, err := fs.Sub(embeddedAssets, dir)
+	if err != nil {
+		return nil, err
+	}
+	if theme_dir == "" {
+		return base, nil
+	}
+	return overlayFS{Override: os.DirFS(filepath.Join(theme_dir, dir)), Base: base}, nil
+}
+
+type staticAssets struct {
+	Files fs.FS
+
+	hashed    map[string]string
+	originals map[string]string
+}
+
+func hashedName(name string, data []byte) string {
+	sum := sha256.Sum256(data)
+	ext := path.Ext(name)
+	return strings.TrimSuffix(name, ext) + "." + hex.EncodeToString(sum[:])[:12] + ext
+}
+
+func newStaticAssets(files fs.FS) (*staticAssets, error) {
+
+	sa := staticAssets{
+		Files:     files,
+		hashed:    make(map[string]string, 0),
+		originals: make(map[string]string, 0),
+	}
+
+	err := fs.WalkDir(files, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		data, err := fs.ReadFile(files, name)
+		if err != nil {
+			return err
+		}
+		hashed := hashedName(name, data)
+		sa.hashed[name] = hashed
+		sa.originals[hashed] = name
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &sa, nil
+}
+
+// Used from the templates to link to static files, e.g. {{ static("base.css") }}
+func (sa *staticAssets) URL(name string) string {
+	if hashed, ok := sa.hashed[name]; ok {
+		return STATIC_URL_PREFIX + hashed
+	}
+	return STATIC_URL_PREFIX + name
+}
+
+func (sa *staticAssets) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	name := strings.TrimPrefix(r.URL.Path, STATIC_URL_PREFIX)
+
+	cache_control := STATIC_PLAIN_CACHE_CONTROL
+	if original, ok := sa.originals[name]; ok {
+		name = original
+		cache_control = STATIC_HASHED_CACHE_CONTROL
+	}
+
+	data, err := fs.ReadFile(sa.Files, name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Cache-Control", cache_control)
+	http.ServeContent(w, r, name, startTime, bytes.NewReader(data))
+}
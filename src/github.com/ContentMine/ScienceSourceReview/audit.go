@@ -0,0 +1,278 @@
+//   Copyright 2019 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	pongo "github.com/flosch/pongo2"
+)
+
+// Our own record of every change made through the tool, one JSON object per line. The wikibase
+// history has the edits too, but not which article they were made from, and not the ones that
+// failed.
+
+const AUDIT_VIEW_LIMIT = 500
+
+// Says whether an edit was made to the real wikibase or only journalled
+const AUDIT_MODE_LIVE = "live"
+const AUDIT_MODE_SANDBOX = "sandbox"
+const AUDIT_MODE_TRAINING = "training"
+
+// A single call to the wikibase API made as part of an operation
+type auditCall struct {
+	Call     string            `json:"call"`
+	Payload  map[string]string `json:"payload"`
+	NewID    string            `json:"new_id,omitempty"`
+	Revision int               `json:"revision,omitempty"`
+	Error    string            `json:"error,omitempty"`
+}
+
+// One operation a reviewer asked for, such as recording a claim, with every call it made. An
+// operation that failed before getting to the wikibase has no calls, but still has an entry.
+type auditEntry struct {
+	Time      time.Time   `json:"time"`
+	Instance  string      `json:"instance"`
+	RequestID string      `json:"request_id"`
+	User      string      `json:"user"`
+	Mode      string      `json:"mode"`
+	Action    string      `json:"action"`
+	Article   string      `json:"article"`
+	Items     []string    `json:"items,omitempty"`
+	Calls     []auditCall `json:"calls"`
+	Error     string      `json:"error,omitempty"`
+}
+
+type auditLog struct {
+	Path string
+
+	lock sync.Mutex
+}
+
+// Makes sure we can write to the log before we start, rather than finding out on the first edit.
+// An empty path turns auditing off.
+func newAuditLog(path string) (*auditLog, error) {
+
+	if path == "" {
+		return nil, nil
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+
+	return &auditLog{Path: path}, nil
+}
+
+// The file is opened for each entry, so it can be rotated from under us
+func (al *auditLog) Append(entry auditEntry) error {
+
+	if al == nil {
+		return nil
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	al.lock.Lock()
+	defer al.lock.Unlock()
+
+	f, err := os.OpenFile(al.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(line, '\n'))
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Returns the most recent entries that match, newest first. Lines we can't parse are skipped, as
+// a partly written line shouldn't stop anyone seeing the rest.
+func (al *auditLog) Read(match func(auditEntry) bool, limit int) ([]auditEntry, error) {
+
+	f, err := os.Open(al.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := make([]auditEntry, 0)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry auditEntry
+		if json.Unmarshal(scanner.Bytes(), &entry) != nil {
+			continue
+		}
+		if match(entry) {
+			entries = append(entries, entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Time.After(entries[j].Time) })
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries, nil
+}
+
+// The editing token is left out of the payload as it's as good as a password for as long as it
+// lasts.
+func newAuditCall(call string, form url.Values, res *wikibaseAPIResponse, err error) auditCall {
+
+	payload := make(map[string]string, len(form))
+	for key := range form {
+		if key != "token" {
+			payload[key] = form.Get(key)
+		}
+	}
+
+	audit_call := auditCall{Call: call, Payload: payload}
+	if res != nil {
+		audit_call.Revision = res.Revision()
+		if res.Entity != nil {
+			audit_call.NewID = res.Entity.ID
+		}
+	}
+	if err != nil {
+		audit_call.Error = err.Error()
+	}
+	return audit_call
+}
+
+// Runs one of the claim writer's operations and records it in the audit log, whether it worked or
+// not. Items the operation made are added to the given ones, so that an operation that failed
+// part way through still says what it left behind.
+func (cw *claimWriter) audited(action string, items []string, f func() error) error {
+
+	cw.calls = make([]auditCall, 0)
+	err := f()
+
+	for _, call := range cw.calls {
+		if call.NewID != "" {
+			items = append(items, call.NewID)
+		}
+	}
+
+	ctx := cw.ctx
+	entry := auditEntry{
+		Time:      time.Now().UTC(),
+		Instance:  ctx.Configuration.Name,
+		RequestID: ctx.RequestID,
+		User:      ctx.Username,
+		Mode:      cw.mode,
+		Action:    action,
+		Article:   cw.article,
+		Items:     items,
+		Calls:     cw.calls,
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	cw.calls = nil
+
+	if aerr := ctx.Audit.Append(entry); aerr != nil {
+		ctx.Log("error", "Failed to write audit log", logFields{"error": aerr, "entry": entry})
+	}
+	return err
+}
+
+// Goes on what the session says, so is only good enough for deciding what links to show. The
+// admin pages themselves use checkAdmin.
+func (ctx *ServerContext) IsAdmin() bool {
+	if ctx.AccessToken == nil || ctx.Username == "" {
+		return false
+	}
+	for _, admin := range ctx.Configuration.Admins {
+		if admin == ctx.Username {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks with the wikibase that the session's access token really belongs to the admin the
+// session names, so that getting hold of the session key isn't enough to get in
+func (ctx *ServerContext) checkAdmin(message string) error {
+
+	if !ctx.IsAdmin() {
+		return unauthorisedError(message, nil)
+	}
+
+	username, err := ctx.fetchUsername(ctx.AccessToken)
+	if err != nil {
+		return err
+	}
+	if username != ctx.Username {
+		ctx.Log("warning", "Session username doesn't match its access token", logFields{"session_user": ctx.Username, "token_user": username})
+		return unauthorisedError(message, nil)
+	}
+	return nil
+}
+
+func auditHandler(ctx *ServerContext, w http.ResponseWriter, r *http.Request) {
+
+	err := ctx.checkAdmin("You must be logged in as an administrator to see the audit log.")
+	if err != nil {
+		ctx.renderError(w, err)
+		return
+	}
+	if ctx.Audit == nil {
+		ctx.renderError(w, notFoundError("The audit log isn't turned on for this server."))
+		return
+	}
+
+	values := r.URL.Query()
+	user := values.Get("user")
+	article := values.Get("article")
+
+	entries, err := ctx.Audit.Read(func(entry auditEntry) bool {
+		return entry.Instance == ctx.Configuration.Name &&
+			(user == "" || entry.User == user) &&
+			(article == "" || entry.Article == article)
+	}, AUDIT_VIEW_LIMIT)
+	if err != nil {
+		ctx.renderError(w, err)
+		return
+	}
+
+	err = ctx.Templates.ExecuteWriter("audit.html", pongo.Context{
+		"entries": entries,
+		"user":    user,
+		"article": article,
+		"limit":   AUDIT_VIEW_LIMIT,
+		"ctx":     ctx,
+	}, w)
+	if err != nil {
+		ctx.renderError(w, err)
+	}
+}
@@ -15,22 +15,74 @@
 package main
 
 import (
-	"log"
+	"context"
+	"encoding/json"
+	"fmt"
 	"net/http"
 
 	"github.com/mrjones/oauth"
 )
 
+const USER_INFO_API_URL = "%s/w/api.php?action=query&meta=userinfo&format=json"
+
+type userInfoResponse struct {
+	Query struct {
+		UserInfo struct {
+			ID   int    `json:"id"`
+			Name string `json:"name"`
+		} `json:"userinfo"`
+	} `json:"query"`
+}
+
+// Asks the wikibase who the access token belongs to, so we can say who did what in the logs
+func (ctx *ServerContext) fetchUsername(token *oauth.AccessToken) (string, error) {
+
+	client, err := ctx.OAuthConsumer.MakeHttpClient(token)
+	if err != nil {
+		return "", err
+	}
+
+	var info userInfoResponse
+	err = ctx.callUpstream("wikibase", "userinfo", true, func(call_ctx context.Context) error {
+		req, err := http.NewRequest("GET", fmt.Sprintf(USER_INFO_API_URL, ctx.Configuration.WikibaseURL), nil)
+		if err != nil {
+			return err
+		}
+
+		resp, err := client.Do(req.WithContext(call_ctx))
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return &httpStatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+		}
+
+		return json.NewDecoder(resp.Body).Decode(&info)
+	})
+
+	return info.Query.UserInfo.Name, err
+}
+
 func authHandler(ctx *ServerContext, w http.ResponseWriter, r *http.Request) {
 
 	ctx.OAuthConsumer.AdditionalParams = map[string]string{
 		"title": "Special:OAuth/initiate",
 	}
 
-	token, requestUrl, err := ctx.OAuthConsumer.GetRequestTokenAndUrl("oob")
-	if err != nil {
-		log.Printf("Error getting token: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	var token *oauth.RequestToken
+	var requestUrl string
+	err := ctx.withOAuthContext(func() error {
+		var err error
+		token, requestUrl, err = ctx.OAuthConsumer.GetRequestTokenAndUrl("oob")
+		return err
+	})
+	if ctx.Context.Err() != nil {
+		ctx.renderError(w, requestContextError(ctx.Context.Err()))
+		return
+	} else if err != nil {
+		ctx.renderError(w, upstreamError("wikibase", err))
 		return
 	}
 
@@ -39,8 +91,7 @@ func authHandler(ctx *ServerContext, w http.ResponseWriter, r *http.Request) {
 
 	err = ctx.CookieSession.Save(r, w)
 	if err != nil {
-		log.Printf("Error saving token: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		ctx.renderError(w, err)
 		return
 	}
 
@@ -58,29 +109,53 @@ func getTokenHandler(ctx *ServerContext, w http.ResponseWriter, r *http.Request)
 		ctx.OAuthConsumer.AdditionalParams = map[string]string{
 			"title": "Special:OAuth/token",
 		}
-		accessToken, err := ctx.OAuthConsumer.AuthorizeToken(&request, verificationCode)
-		if err != nil {
-			log.Printf("Error getting access token: %v", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		var accessToken *oauth.AccessToken
+		err := ctx.withOAuthContext(func() error {
+			var err error
+			accessToken, err = ctx.OAuthConsumer.AuthorizeToken(&request, verificationCode)
+			return err
+		})
+		oauthLogins.Inc(ctx.Configuration.Name, resultLabel(err))
+		if ctx.Context.Err() != nil {
+			ctx.renderError(w, requestContextError(ctx.Context.Err()))
+			return
+		} else if err != nil {
+			ctx.renderError(w, unauthorisedError("We couldn't log you in to Science Source. Please try again.", err))
 			return
 		}
 
 		ctx.CookieSession.Values["auth"] = &accessToken
+		err = ctx.newCSRFToken()
+		if err != nil {
+			ctx.renderError(w, err)
+			return
+		}
+
+		username, err := ctx.fetchUsername(accessToken)
+		if err != nil {
+			ctx.Log("warning", "Failed to get username", logFields{"error": err})
+		} else {
+			ctx.Username = username
+			ctx.CookieSession.Values["username"] = username
+		}
 		ctx.CookieSession.Save(r, w)
 
-		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		http.Redirect(w, r, ctx.Configuration.Path+"/", http.StatusTemporaryRedirect)
 	} else {
-		log.Printf("Failed to get request data")
-		http.Error(w, "Failed to get request data", http.StatusInternalServerError)
+		ctx.renderError(w, badRequestError("Your login request had expired or was incomplete. Please try logging in again.", nil))
 		return
 	}
 }
 
 func deauthHandler(ctx *ServerContext, w http.ResponseWriter, r *http.Request) {
 
+	if ctx.AccessToken != nil {
+		activeSessions.Forget(ctx.Configuration.Name, ctx.AccessToken.Token)
+	}
+
 	// Setting the max age to -ve should delete the cookie session
 	ctx.CookieSession.Options.MaxAge = -1
 	ctx.CookieSession.Save(r, w)
 
-	http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+	http.Redirect(w, r, ctx.Configuration.Path+"/", http.StatusTemporaryRedirect)
 }
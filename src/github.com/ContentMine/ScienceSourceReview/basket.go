@@ -0,0 +1,390 @@
+//   Copyright 2019 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	pongo "github.com/flosch/pongo2"
+	"github.com/gorilla/mux"
+
+	"github.com/ContentMine/wikibase"
+)
+
+// The basket lets a reviewer pick several drug/disease pairs from an article and then confirm
+// them all at once. It lives in the cookie session like everything else, so is kept small: the
+// whole cookie has to fit in 4KB, and if it doesn't the session can't be saved at all.
+const MAX_BASKET_SIZE = 20
+const BASKET_SESSION_PREFIX = "basket-"
+
+// Across all the articles in the session. When there are more than this the baskets for the
+// articles used longest ago are dropped.
+const MAX_BASKET_TOTAL = 40
+const BASKET_ORDER_SESSION_KEY = "basket_order"
+
+type basketPair struct {
+	Drug    wikibase.ItemPropertyType
+	Disease wikibase.ItemPropertyType
+}
+
+// Pairs are stored in the session as strings so we don't need to register a type with gob
+func (p basketPair) Key() string {
+	return string(p.Drug) + "|" + string(p.Disease)
+}
+
+func parseBasketPair(key string) (basketPair, bool) {
+	parts := strings.Split(key, "|")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return basketPair{}, false
+	}
+	return basketPair{Drug: wikibase.ItemPropertyType(parts[0]), Disease: wikibase.ItemPropertyType(parts[1])}, true
+}
+
+type basket []basketPair
+
+func (b basket) Contains(pair basketPair) bool {
+	for _, p := range b {
+		if p == pair {
+			return true
+		}
+	}
+	return false
+}
+
+func (b basket) Remove(pair basketPair) basket {
+	res := make(basket, 0, len(b))
+	for _, p := range b {
+		if p != pair {
+			res = append(res, p)
+		}
+	}
+	return res
+}
+
+// Each article gets its own basket, so reviewing one doesn't muddle up another
+func (ctx *ServerContext) getBasket(article_id string) basket {
+
+	keys, _ := ctx.CookieSession.Values[BASKET_SESSION_PREFIX+article_id].([]string)
+	res := make(basket, 0, len(keys))
+	for _, key := range keys {
+		if pair, ok := parseBasketPair(key); ok {
+			res = append(res, pair)
+		}
+	}
+	return res
+}
+
+func (ctx *ServerContext) saveBasket(article_id string, b basket, w http.ResponseWriter, r *http.Request) error {
+
+	values := ctx.CookieSession.Values
+
+	// Articles with baskets, least recently used first. Any baskets not in the list are from
+	// before we kept one, so count as oldest.
+	order, _ := values[BASKET_ORDER_SESSION_KEY].([]string)
+	listed := make(map[string]bool, len(order))
+	for _, id := range order {
+		listed[id] = true
+	}
+	articles := make([]string, 0, len(order))
+	for key := range values {
+		if name, ok := key.(string); ok && strings.HasPrefix(name, BASKET_SESSION_PREFIX) {
+			id := strings.TrimPrefix(name, BASKET_SESSION_PREFIX)
+			if !listed[id] {
+				articles = append(articles, id)
+			}
+		}
+	}
+	sort.Strings(articles)
+	for _, id := range order {
+		if id != article_id {
+			articles = append(articles, id)
+		}
+	}
+
+	if len(b) == 0 {
+		delete(values, BASKET_SESSION_PREFIX+article_id)
+	} else {
+		keys := make([]string, len(b))
+		for i, pair := range b {
+			keys[i] = pair.Key()
+		}
+		values[BASKET_SESSION_PREFIX+article_id] = keys
+		articles = append(articles, article_id)
+	}
+
+	total := 0
+	for _, id := range articles {
+		keys, _ := values[BASKET_SESSION_PREFIX+id].([]string)
+		total += len(keys)
+	}
+	for total > MAX_BASKET_TOTAL && len(articles) > 1 {
+		keys, _ := values[BASKET_SESSION_PREFIX+articles[0]].([]string)
+		total -= len(keys)
+		delete(values, BASKET_SESSION_PREFIX+articles[0])
+		articles = articles[1:]
+	}
+
+	if len(articles) == 0 {
+		delete(values, BASKET_ORDER_SESSION_KEY)
+	} else {
+		values[BASKET_ORDER_SESSION_KEY] = articles
+	}
+	return ctx.CookieSession.Save(r, w)
+}
+
+// A pair from the basket along with its annotations, and once we've tried to record it, how
+// that went
+type basketItem struct {
+	Pair           basketPair
+	Key            string
+	Drug           *AnnotationInfo
+	Disease        *AnnotationInfo
+	ExactDuplicate bool
+	Duplicates     []ClaimInfo
+	Result         string
+	Message        string
+}
+
+const BASKET_RESULT_RECORDED = "recorded"
+const BASKET_RESULT_DUPLICATE = "duplicate"
+const BASKET_RESULT_SKIPPED = "skipped"
+const BASKET_RESULT_FAILED = "failed"
+const BASKET_RESULT_NOT_ATTEMPTED = "not attempted"
+
+// Looks up the annotations for each pair, dropping any that are no longer in the article or
+// have since been flagged as incorrect, and checks each for duplicates both against existing claims and earlier pairs in the basket.
+func (b basket) Resolve(annotations []*AnnotationInfo) []*basketItem {
+
+	set := make(map[wikibase.ItemPropertyType]*AnnotationInfo, len(annotations))
+	for _, annotation := range annotations {
+		set[annotation.AnnotationID] = annotation
+	}
+
+	items := make([]*basketItem, 0, len(b))
+	for _, pair := range b {
+		drug, drug_ok := set[pair.Drug]
+		disease, disease_ok := set[pair.Disease]
+		if !drug_ok || !disease_ok || drug.Flagged || disease.Flagged {
+			continue
+		}
+
+		exact, duplicates := findDuplicateClaims(annotations, drug, disease)
+		if !exact {
+			for _, earlier := range items {
+				if sameTerm(earlier.Drug, drug) && sameTerm(earlier.Disease, disease) {
+					duplicates = append(duplicates, ClaimInfo{Drug: earlier.Drug, Disease: earlier.Disease})
+				}
+			}
+		}
+
+		items = append(items, &basketItem{
+			Pair:           pair,
+			Key:            pair.Key(),
+			Drug:           drug,
+			Disease:        disease,
+			ExactDuplicate: exact,
+			Duplicates:     duplicates,
+		})
+	}
+	return items
+}
+
+// Writes each confirmed pair in turn with a single editing token, carrying on past failures so
+// the reviewer gets a result for every pair. Pairs that are term level duplicates are only
+// written if the reviewer ticked them off.
+func (ctx *ServerContext) recordBasket(article_id string, items []*basketItem, confirmed_duplicates map[string]bool) {
+
+	writer := ctx.newClaimWriter(article_id)
+	for _, item := range items {
+
+		if item.ExactDuplicate {
+			item.Result = BASKET_RESULT_DUPLICATE
+			item.Message = "Already recorded."
+			continue
+		}
+		if len(item.Duplicates) > 0 && !confirmed_duplicates[item.Key] {
+			item.Result = BASKET_RESULT_SKIPPED
+			item.Message = "These terms are already linked in this article; tick the box to record it anyway."
+			continue
+		}
+		if ctx.Context.Err() != nil {
+			item.Result = BASKET_RESULT_NOT_ATTEMPTED
+			item.Message = "We ran out of time before getting to this one."
+			continue
+		}
+
+		err := writer.Record(item.Drug, item.Disease)
+		if err != nil {
+			ctx.Log("warning", "Failed to record claim from basket", logFields{"error": err, "pair": item.Key})
+			item.Result = BASKET_RESULT_FAILED
+			item.Message = userMessage(err)
+		} else {
+			item.Result = BASKET_RESULT_RECORDED
+		}
+	}
+}
+
+func basketHandler(ctx *ServerContext, w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "GET" && r.Method != "POST" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		ctx.renderError(w, badRequestError("We couldn't read the submitted form.", err))
+		return
+	}
+
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	article, annotations, _, err := ctx.getArticleAndAnnotations(id)
+	if err != nil {
+		ctx.renderError(w, err)
+		return
+	}
+
+	b := ctx.getBasket(id)
+
+	action := ""
+	if r.Method == "POST" {
+		action = r.FormValue("action")
+		if r.FormValue("remove") != "" {
+			action = "remove"
+		}
+	}
+
+	switch action {
+	case "":
+		// Just show the basket
+
+	case "add":
+		pair := basketPair{
+			Drug:    wikibase.ItemPropertyType(r.FormValue("drug")),
+			Disease: wikibase.ItemPropertyType(r.FormValue("disease")),
+		}
+		for _, annotation := range annotations {
+			if annotation.AnnotationID == pair.Drug || annotation.AnnotationID == pair.Disease {
+				if err := flaggedError(annotation); err != nil {
+					ctx.renderError(w, err)
+					return
+				}
+			}
+		}
+		if len(basket{pair}.Resolve(annotations)) == 0 {
+			ctx.renderError(w, badRequestError("Please go back and select one drug and one disease from this article.",
+				fmt.Errorf("missing annotation info: drug %q disease %q", pair.Drug, pair.Disease)))
+			return
+		}
+		if !b.Contains(pair) {
+			if len(b) >= MAX_BASKET_SIZE {
+				ctx.renderError(w, badRequestError(fmt.Sprintf("You can only have %d pairs in your basket at once. Please confirm or remove some first.", MAX_BASKET_SIZE), nil))
+				return
+			}
+			b = append(b, pair)
+		}
+		err = ctx.saveBasket(id, b, w, r)
+		if err != nil {
+			ctx.renderError(w, err)
+			return
+		}
+		http.Redirect(w, r, "../", http.StatusSeeOther)
+		return
+
+	case "remove":
+		if pair, ok := parseBasketPair(r.FormValue("remove")); ok {
+			b = b.Remove(pair)
+		}
+		err = ctx.saveBasket(id, b, w, r)
+		if err != nil {
+			ctx.renderError(w, err)
+			return
+		}
+		http.Redirect(w, r, ".", http.StatusSeeOther)
+		return
+
+	case "clear":
+		err = ctx.saveBasket(id, nil, w, r)
+		if err != nil {
+			ctx.renderError(w, err)
+			return
+		}
+		http.Redirect(w, r, "../", http.StatusSeeOther)
+		return
+
+	case "confirm":
+		if ctx.AccessToken == nil {
+			ctx.renderError(w, unauthorisedError("You must be logged in to record claims.", nil))
+			return
+		}
+		err = ctx.checkCSRF(r)
+		if err != nil {
+			ctx.renderError(w, err)
+			return
+		}
+		if r.FormValue("confirm") != "true" {
+			ctx.renderError(w, badRequestError("Please tick the box to confirm you want to record these claims.", nil))
+			return
+		}
+
+		confirmed_duplicates := make(map[string]bool)
+		for _, key := range r.Form["confirm_duplicate"] {
+			confirmed_duplicates[key] = true
+		}
+
+		items := b.Resolve(annotations)
+		ctx.recordBasket(id, items, confirmed_duplicates)
+
+		// Keep anything that still needs doing in the basket so they can try again
+		remaining := make(basket, 0)
+		for _, item := range items {
+			if item.Result != BASKET_RESULT_RECORDED && item.Result != BASKET_RESULT_DUPLICATE {
+				remaining = append(remaining, item.Pair)
+			}
+		}
+		err = ctx.saveBasket(id, remaining, w, r)
+		if err != nil {
+			ctx.Log("warning", "Failed to save basket", logFields{"error": err})
+		}
+
+		err = ctx.Templates.ExecuteWriter("basket_results.html", pongo.Context{
+			"title": article.Title,
+			"items": items,
+			"ctx":   ctx,
+		}, w)
+		if err != nil {
+			ctx.renderError(w, err)
+		}
+		return
+
+	default:
+		ctx.renderError(w, badRequestError("We didn't understand what you wanted to do with your basket.", fmt.Errorf("unknown basket action %q", action)))
+		return
+	}
+
+	err = ctx.Templates.ExecuteWriter("basket.html", pongo.Context{
+		"title": article.Title,
+		"items": b.Resolve(annotations),
+		"ctx":   ctx,
+	}, w)
+	if err != nil {
+		ctx.renderError(w, err)
+	}
+}
@@ -0,0 +1,238 @@
+//   Copyright 2019 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/ContentMine/wikibase"
+)
+
+// Claims are meant to go from a drug annotation to a disease annotation in the same article, but
+// the wikibase doesn't enforce that. Someone editing by hand may have linked them the other way
+// round, or to an annotation in another article, or to something that has since been deleted,
+// so we find claims from either end and look up anything we don't already know about.
+
+// The form of an item ID on the wikibase itself
+var WIKIDATA_ID_PATTERN = regexp.MustCompile(`^Q[0-9]+$`)
+
+// Claims made on annotations anywhere that point at annotations in this article
+const INCOMING_CLAIMS_SPARQL = `
+SELECT ?source ?target WHERE {
+  ?anchor wdt:{anchorin} wd:%s.
+  ?target wdt:{basedon} ?anchor.
+  ?source wdt:{claim} ?target.
+}
+`
+
+// Everything is optional so that we still get a row for items that aren't annotations
+const ANNOTATION_DETAILS_SPARQL = `
+SELECT ?annotation ?anchor ?article ?term ?dictionary ?Wikidata_item_code ?preceding_phrase ?following_phrase ?character_number WHERE {
+  VALUES ?annotation { %s }
+  OPTIONAL {
+    ?annotation wdt:{basedon} ?anchor.
+    OPTIONAL { ?anchor wdt:{anchorin} ?article. }
+    OPTIONAL { ?anchor wdt:{offset} ?character_number. }
+    OPTIONAL { ?anchor wdt:{preceding_phrase} ?preceding_phrase. }
+    OPTIONAL { ?anchor wdt:{following_phrase} ?following_phrase. }
+  }
+  OPTIONAL { ?annotation wdt:{term} ?term. }
+  OPTIONAL { ?annotation wdt:{dictionary} ?dictionary. }
+  OPTIONAL { ?annotation wdt:{wikidataid} ?Wikidata_item_code. }
+}
+`
+
+type claimLink struct {
+	Source wikibase.ItemPropertyType
+	Target wikibase.ItemPropertyType
+}
+
+// As with the drug and disease lists on the article page, we guess from the dictionary name
+func isDrug(annotation *AnnotationInfo) bool {
+	return strings.Contains(annotation.Dictionary, "drug")
+}
+
+func (ctx *ServerContext) itemID(uri string) wikibase.ItemPropertyType {
+	return wikibase.ItemPropertyType(strings.TrimPrefix(uri, ctx.Configuration.EntityPrefix))
+}
+
+func (ctx *ServerContext) getIncomingClaims(article_id string) ([]claimLink, error) {
+
+	query := ctx.PrepareSPARQL(INCOMING_CLAIMS_SPARQL)
+	resp, err := ctx.querySPARQL("incoming_claims", fmt.Sprintf(query, article_id))
+	if err != nil {
+		return nil, err
+	}
+
+	links := make([]claimLink, 0, len(resp.Results.Bindings))
+	for _, binding := range resp.Results.Bindings {
+		links = append(links, claimLink{
+			Source: ctx.itemID(binding["source"].Value),
+			Target: ctx.itemID(binding["target"].Value),
+		})
+	}
+	return links, nil
+}
+
+// Looks up annotations that aren't in this article. Anything that isn't an annotation, or no
+// longer exists, is left out of the result. Claim values that aren't local items, such as
+// unknown values, links elsewhere, or items made in the sandbox, can't go in the query so are
+// left out too.
+func (ctx *ServerContext) getAnnotationDetails(ids []wikibase.ItemPropertyType) (map[wikibase.ItemPropertyType]*AnnotationInfo, error) {
+
+	res := make(map[wikibase.ItemPropertyType]*AnnotationInfo, len(ids))
+
+	values := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if WIKIDATA_ID_PATTERN.MatchString(string(id)) {
+			values = append(values, "wd:"+string(id))
+		}
+	}
+	if len(values) == 0 {
+		return res, nil
+	}
+
+	query := ctx.PrepareSPARQL(ANNOTATION_DETAILS_SPARQL)
+	resp, err := ctx.querySPARQL("annotation_details", fmt.Sprintf(query, strings.Join(values, " ")))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, binding := range resp.Results.Bindings {
+		if binding["term"].Value == "" {
+			continue
+		}
+		annotation_id := ctx.itemID(binding["annotation"].Value)
+		if _, ok := res[annotation_id]; ok {
+			continue
+		}
+		res[annotation_id] = &AnnotationInfo{
+			AnchorID:        ctx.itemID(binding["anchor"].Value),
+			AnchorRaw:       binding["anchor"].Value,
+			AnnotationID:    annotation_id,
+			AnnotationRaw:   binding["annotation"].Value,
+			ArticleID:       ctx.itemID(binding["article"].Value),
+			Term:            binding["term"].Value,
+			Dictionary:      binding["dictionary"].Value,
+			WikidataID:      binding["Wikidata_item_code"].Value,
+			Offset:          binding["character_number"].Value,
+			PrecedingPhrase: binding["preceding_phrase"].Value,
+			FollowingPhrase: binding["following_phrase"].Value,
+			Claims:          make([]wikibase.ItemPropertyType, 0),
+		}
+	}
+	return res, nil
+}
+
+// Builds the list of claims involving this article from the outgoing claims on its annotations
+// and the incoming ones we've been given, fetching the far end of any that leave the article.
+func (ctx *ServerContext) resolveClaims(article_id string, annotations []*AnnotationInfo, incoming []claimLink) ([]ClaimInfo, error) {
+
+	set := make(map[wikibase.ItemPropertyType]*AnnotationInfo, len(annotations))
+	for _, annotation := range annotations {
+		set[annotation.AnnotationID] = annotation
+	}
+
+	seen := make(map[claimLink]bool, 0)
+	links := make([]claimLink, 0)
+	for _, annotation := range annotations {
+		for _, claim := range annotation.Claims {
+			link := claimLink{Source: annotation.AnnotationID, Target: claim}
+			if !seen[link] {
+				seen[link] = true
+				links = append(links, link)
+			}
+		}
+	}
+	for _, link := range incoming {
+		if !seen[link] {
+			seen[link] = true
+			links = append(links, link)
+		}
+	}
+
+	unknown := make([]wikibase.ItemPropertyType, 0)
+	queued := make(map[wikibase.ItemPropertyType]bool, 0)
+	for _, link := range links {
+		for _, id := range []wikibase.ItemPropertyType{link.Source, link.Target} {
+			if set[id] == nil && !queued[id] {
+				queued[id] = true
+				unknown = append(unknown, id)
+			}
+		}
+	}
+	sort.Slice(unknown, func(i, j int) bool { return unknown[i] < unknown[j] })
+
+	external, err := ctx.getAnnotationDetails(unknown)
+	if err != nil {
+		return nil, err
+	}
+	lookup := func(id wikibase.ItemPropertyType) *AnnotationInfo {
+		if annotation, ok := set[id]; ok {
+			return annotation
+		}
+		return external[id]
+	}
+
+	claims := make([]ClaimInfo, 0, len(links))
+	for _, link := range links {
+		source := lookup(link.Source)
+		target := lookup(link.Target)
+
+		claim := ClaimInfo{
+			External: (source != nil && set[link.Source] == nil) || (target != nil && set[link.Target] == nil),
+		}
+
+		switch {
+		case source == nil || target == nil:
+			// We only get here with one end missing, as one end is always in the article
+			claim.Dangling = true
+			known, missing := source, link.Target
+			if known == nil {
+				known, missing = target, link.Source
+			}
+			claim.DanglingID = missing
+			if isDrug(known) {
+				claim.Drug = known
+			} else {
+				claim.Disease = known
+			}
+		case !isDrug(source) && isDrug(target):
+			claim.Drug = target
+			claim.Disease = source
+			claim.Reversed = true
+		default:
+			claim.Drug = source
+			claim.Disease = target
+		}
+
+		claims = append(claims, claim)
+	}
+
+	dangling := 0
+	for _, claim := range claims {
+		if claim.Dangling {
+			dangling += 1
+		}
+	}
+	if dangling > 0 {
+		ctx.Log("warning", "Article has dangling claims", logFields{"article": article_id, "dangling": dangling})
+	}
+
+	return claims, nil
+}
@@ -0,0 +1,59 @@
+//   Copyright 2019 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+)
+
+// The forms that write to the wikibase carry a token tied to the reviewer's session, so another
+// site can't get a logged in reviewer's browser to submit one for them. The session cookie is
+// also SameSite=Lax, which should stop such requests carrying it at all, but not every browser
+// honours that.
+
+const CSRF_SESSION_KEY = "csrf"
+const CSRF_FORM_FIELD = "csrf_token"
+
+// Gives the session a new token. We only need one once the reviewer is logged in, as that's
+// when they can write.
+func (ctx *ServerContext) newCSRFToken() error {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return err
+	}
+	ctx.CookieSession.Values[CSRF_SESSION_KEY] = hex.EncodeToString(b)
+	return nil
+}
+
+// For the templates to put in a hidden CSRF_FORM_FIELD input
+func (ctx *ServerContext) CSRFToken() string {
+	token, _ := ctx.CookieSession.Values[CSRF_SESSION_KEY].(string)
+	return token
+}
+
+// Should be called once we know the reviewer is logged in and before we write anything
+func (ctx *ServerContext) checkCSRF(r *http.Request) error {
+	token := ctx.CSRFToken()
+	if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(r.FormValue(CSRF_FORM_FIELD))) != 1 {
+		return forbiddenError("This form has expired. Please go back, reload the page and try again.",
+			fmt.Errorf("missing or mismatched CSRF token"))
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+//   Copyright 2019 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+)
+
+const ENVIRONMENT_PREFIX = "SSR_"
+const ENVIRONMENT_FILE_SUFFIX = "_FILE"
+
+// Describes a single configuration value that can be set from the environment, worked out from
+// the JSON tags on ServerConfig so that new fields get an environment variable for free.
+type environmentField struct {
+	Name  string
+	Value reflect.Value
+}
+
+func environmentFields(prefix string, v reflect.Value) []environmentField {
+
+	fields := make([]environmentField, 0)
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		tag := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if tag == "" || tag == "-" {
+			continue
+		}
+		name := prefix + strings.ToUpper(tag)
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct {
+			fields = append(fields, environmentFields(name+"_", field)...)
+		} else {
+			fields = append(fields, environmentField{Name: name, Value: field})
+		}
+	}
+	return fields
+}
+
+// Strings are taken as is, anything else (bools, numbers, maps, lists) is parsed as JSON.
+func (f environmentField) set(value string) error {
+
+	if f.Value.Kind() == reflect.String {
+		f.Value.SetString(value)
+		return nil
+	}
+
+	target := reflect.New(f.Value.Type())
+	err := json.Unmarshal([]byte(value), target.Interface())
+	if err != nil {
+		return fmt.Errorf("failed to parse %s: %v", f.Name, err)
+	}
+	f.Value.Set(target.Elem())
+	return nil
+}
+
+// Overrides config values from the environment. For each field SSR_<NAME> sets the value
+// directly, and SSR_<NAME>_FILE names a file to read it from, which is how Docker and Kubernetes
+// expose secrets. Setting both for the same field is an error.
+func applyEnvironment(prefix string, v reflect.Value) error {
+
+	for _, field := range environmentFields(prefix, v) {
+
+		value, has_value := os.LookupEnv(field.Name)
+		path, has_path := os.LookupEnv(field.Name + ENVIRONMENT_FILE_SUFFIX)
+
+		if has_value && has_path {
+			return fmt.Errorf("both %s and %s%s are set", field.Name, field.Name, ENVIRONMENT_FILE_SUFFIX)
+		}
+
+		if has_path {
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return fmt.Errorf("failed to read %s%s: %v", field.Name, ENVIRONMENT_FILE_SUFFIX, err)
+			}
+			// Secret files are frequently written with a trailing newline
+			value = strings.TrimRight(string(data), "\r\n")
+			has_value = true
+		}
+
+		if has_value {
+			err := field.set(value)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Top level values are set from SSR_<NAME>. Instance values are too when there is only one
+// instance, so older single instance deployments carry on working, otherwise the upper-cased
+// instance name is added, so the secret for the instance "live" is SSR_LIVE_OAUTH_SECRET.
+func (config *Config) applyEnvironment() error {
+
+	err := applyEnvironment(ENVIRONMENT_PREFIX, reflect.ValueOf(config).Elem())
+	if err != nil {
+		return err
+	}
+
+	if len(config.Instances) == 0 {
+		config.Instances = []ServerConfig{{}}
+	}
+
+	for i := range config.Instances {
+		prefix := ENVIRONMENT_PREFIX
+		if len(config.Instances) > 1 {
+			prefix += strings.ToUpper(config.Instances[i].Name) + "_"
+		}
+		err = applyEnvironment(prefix, reflect.ValueOf(&config.Instances[i]).Elem())
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func printEnvironmentUsage(w io.Writer) {
+
+	fmt.Fprintf(w, "\nConfiguration is applied in the following order, with later sources taking precedence:\n")
+	fmt.Fprintf(w, "  1. the JSON file given by -config (skipped if -config is empty)\n")
+	fmt.Fprintf(w, "  2. environment variables, either SSR_<NAME> holding the value, or SSR_<NAME>_FILE naming a file\n")
+	fmt.Fprintf(w, "     that holds it, for use with Docker/Kubernetes secrets. Setting both is an error.\n")
+	fmt.Fprintf(w, "Non-string values are given as JSON.\n")
+	fmt.Fprintf(w, "\nEnvironment variables:\n")
+
+	var config Config
+	for _, field := range environmentFields(ENVIRONMENT_PREFIX, reflect.ValueOf(&config).Elem()) {
+		fmt.Fprintf(w, "  %s (%s)\n", field.Name, field.Value.Type())
+	}
+
+	fmt.Fprintf(w, "\nPer instance environment variables, where <INSTANCE>_ is only needed if there is more than one instance:\n")
+
+	var instance ServerConfig
+	for _, field := range environmentFields(ENVIRONMENT_PREFIX+"<INSTANCE>_", reflect.ValueOf(&instance).Elem()) {
+		fmt.Fprintf(w, "  %s (%s)\n", field.Name, field.Value.Type())
+	}
+}
@@ -0,0 +1,209 @@
+//   Copyright 2019 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	pongo "github.com/flosch/pongo2"
+)
+
+type errorKind int
+
+const (
+	ERROR_INTERNAL errorKind = iota
+	ERROR_NOT_FOUND
+	ERROR_BAD_REQUEST
+	ERROR_UNAUTHORISED
+	ERROR_FORBIDDEN
+	ERROR_CONFLICT
+	ERROR_UPSTREAM_UNAVAILABLE
+	ERROR_UPSTREAM_REJECTED
+	ERROR_TIMEOUT
+	ERROR_CANCELLED
+)
+
+// Not a real HTTP status, but what nginx uses to log a client going away before we answered
+const STATUS_CLIENT_CLOSED_REQUEST = 499
+
+type errorKindInfo struct {
+	Status int
+	Title  string
+}
+
+var ERROR_KINDS = map[errorKind]errorKindInfo{
+	ERROR_INTERNAL:             {http.StatusInternalServerError, "Something went wrong"},
+	ERROR_NOT_FOUND:            {http.StatusNotFound, "Not found"},
+	ERROR_BAD_REQUEST:          {http.StatusBadRequest, "Bad request"},
+	ERROR_UNAUTHORISED:         {http.StatusUnauthorized, "Not authorised"},
+	ERROR_FORBIDDEN:            {http.StatusForbidden, "Forbidden"},
+	ERROR_CONFLICT:             {http.StatusConflict, "Already recorded"},
+	ERROR_UPSTREAM_UNAVAILABLE: {http.StatusServiceUnavailable, "Science Source unavailable"},
+	ERROR_UPSTREAM_REJECTED:    {http.StatusBadGateway, "Science Source error"},
+	ERROR_TIMEOUT:              {http.StatusGatewayTimeout, "Took too long"},
+	ERROR_CANCELLED:            {STATUS_CLIENT_CLOSED_REQUEST, "Request cancelled"},
+}
+
+// An error along with what we should tell the user about it. The message is shown on the error
+// page, whereas the underlying error may contain details of our backends so is only logged.
+type requestError struct {
+	Kind    errorKind
+	Message string
+	Err     error
+}
+
+func (e *requestError) Error() string {
+	if e.Err == nil {
+		return e.Message
+	}
+	return fmt.Sprintf("%s: %v", e.Message, e.Err)
+}
+
+func (e *requestError) Unwrap() error {
+	return e.Err
+}
+
+func (e *requestError) Status() int {
+	return ERROR_KINDS[e.Kind].Status
+}
+
+func (e *requestError) Title() string {
+	return ERROR_KINDS[e.Kind].Title
+}
+
+func notFoundError(message string) error {
+	return &requestError{Kind: ERROR_NOT_FOUND, Message: message}
+}
+
+func badRequestError(message string, err error) error {
+	return &requestError{Kind: ERROR_BAD_REQUEST, Message: message, Err: err}
+}
+
+func unauthorisedError(message string, err error) error {
+	return &requestError{Kind: ERROR_UNAUTHORISED, Message: message, Err: err}
+}
+
+func forbiddenError(message string, err error) error {
+	return &requestError{Kind: ERROR_FORBIDDEN, Message: message, Err: err}
+}
+
+func conflictError(message string) error {
+	return &requestError{Kind: ERROR_CONFLICT, Message: message}
+}
+
+// For when the request itself finished before we did, either because the reviewer went away or
+// because we ran out of time for the route
+func requestContextError(err error) error {
+	if errors.Is(err, context.Canceled) {
+		return &requestError{
+			Kind:    ERROR_CANCELLED,
+			Message: "The request was cancelled before we finished it.",
+			Err:     err,
+		}
+	}
+	return &requestError{
+		Kind:    ERROR_TIMEOUT,
+		Message: "Science Source took too long to answer. Please try again in a little while.",
+		Err:     err,
+	}
+}
+
+// Works out whether a failed call to the query service or wikibase API failed because we couldn't
+// reach it, or because it didn't like what we asked.
+func upstreamError(service string, err error) error {
+
+	if err == nil {
+		return nil
+	}
+
+	// Don't reclassify errors that have already been through here
+	var existing *requestError
+	if errors.As(err, &existing) {
+		return err
+	}
+
+	if errors.Is(err, errCircuitOpen) {
+		return &requestError{
+			Kind:    ERROR_UPSTREAM_UNAVAILABLE,
+			Message: fmt.Sprintf("The Science Source %s is having problems, so we're giving it a rest for a little while. Please try again shortly.", service),
+			Err:     err,
+		}
+	}
+
+	if isUnavailable(err) {
+		return &requestError{
+			Kind:    ERROR_UPSTREAM_UNAVAILABLE,
+			Message: fmt.Sprintf("We couldn't reach the Science Source %s. Please try again in a little while.", service),
+			Err:     err,
+		}
+	}
+
+	return &requestError{
+		Kind:    ERROR_UPSTREAM_REJECTED,
+		Message: fmt.Sprintf("The Science Source %s couldn't handle our request.", service),
+		Err:     err,
+	}
+}
+
+// The part of an error that's fit to show the user
+func userMessage(err error) string {
+	var req_err *requestError
+	if errors.As(err, &req_err) {
+		return req_err.Message
+	}
+	return "Something unexpected went wrong."
+}
+
+// Logs the full error and shows the user the branded error page with just the message meant
+// for them. Anything that isn't a requestError is treated as an internal error.
+func (ctx *ServerContext) renderError(w http.ResponseWriter, err error) {
+
+	var req_err *requestError
+	if !errors.As(err, &req_err) {
+		req_err = &requestError{
+			Kind:    ERROR_INTERNAL,
+			Message: "Something unexpected went wrong handling your request.",
+			Err:     err,
+		}
+	}
+
+	level := "warning"
+	if req_err.Kind == ERROR_CANCELLED {
+		level = "info"
+	} else if req_err.Status() >= http.StatusInternalServerError {
+		level = "error"
+	}
+	ctx.Log(level, req_err.Message, logFields{"error": err, "status": req_err.Status()})
+
+	// Nobody is listening, so don't bother with the page
+	if req_err.Kind == ERROR_CANCELLED {
+		w.WriteHeader(req_err.Status())
+		return
+	}
+
+	w.WriteHeader(req_err.Status())
+	terr := ctx.Templates.ExecuteWriter("error.html", pongo.Context{
+		"error_title":   req_err.Title(),
+		"error_message": req_err.Message,
+		"ctx":           ctx,
+	}, w)
+	if terr != nil {
+		ctx.Log("error", "Failed to render error page", logFields{"error": terr})
+		fmt.Fprintf(w, "%s: %s\n", req_err.Title(), req_err.Message)
+	}
+}
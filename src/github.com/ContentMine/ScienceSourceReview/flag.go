@@ -0,0 +1,171 @@
+//   Copyright 2019 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	pongo "github.com/flosch/pongo2"
+	"github.com/gorilla/mux"
+
+	"github.com/ContentMine/wikibase"
+)
+
+// The dictionary matching gets things wrong, such as matching abbreviations as diseases, so
+// reviewers can flag an annotation as incorrect. This sets a string property on the annotation
+// holding the reason, and flagged annotations are then kept out of the review tables.
+const FLAG_PROPERTY = "flagged"
+
+const DEFAULT_FLAG_REASON = "incorrect match"
+const MAX_FLAG_REASON_LENGTH = 200
+
+func (ctx *ServerContext) FlaggingEnabled() bool {
+	return ctx.Configuration.PropertyMap[FLAG_PROPERTY] != ""
+}
+
+// Flagged annotations are false positives, so they mustn't end up in claims or as evidence
+func unflagged(annotations []*AnnotationInfo) []*AnnotationInfo {
+	res := make([]*AnnotationInfo, 0, len(annotations))
+	for _, annotation := range annotations {
+		if !annotation.Flagged {
+			res = append(res, annotation)
+		}
+	}
+	return res
+}
+
+func flaggedError(annotations ...*AnnotationInfo) error {
+	for _, annotation := range annotations {
+		if annotation.Flagged {
+			return badRequestError(fmt.Sprintf("This mention of %s has been flagged as incorrect, so can't be used in a claim.", annotation.Term),
+				fmt.Errorf("annotation %s is flagged", annotation.AnnotationID))
+		}
+	}
+	return nil
+}
+
+func (cw *claimWriter) Flag(annotation *AnnotationInfo, reason string) error {
+
+	return cw.audited("flag", []string{string(annotation.AnnotationID)}, func() error {
+
+		value, err := json.Marshal(reason)
+		if err != nil {
+			return err
+		}
+
+		form := url.Values{
+			"action":   []string{"wbcreateclaim"},
+			"entity":   []string{string(annotation.AnnotationID)},
+			"property": []string{cw.ctx.Configuration.PropertyMap[FLAG_PROPERTY]},
+			"snaktype": []string{"value"},
+			"value":    []string{string(value)},
+		}
+		summary := cw.editSummary("Flagged annotation as incorrect: "+reason, annotation.Term)
+		return cw.callAPI("flag", summary, form, nil)
+	})
+}
+
+func flagHandler(ctx *ServerContext, w http.ResponseWriter, r *http.Request) {
+
+	// Should only be called by POST
+	if r.Method != "POST" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !ctx.FlaggingEnabled() {
+		ctx.renderError(w, notFoundError("Flagging annotations isn't available on this Science Source instance."))
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		ctx.renderError(w, badRequestError("We couldn't read the submitted form.", err))
+		return
+	}
+	annotation_id := wikibase.ItemPropertyType(r.FormValue("annotation"))
+	confirm := r.FormValue("confirm")
+	reason := strings.TrimSpace(r.FormValue("reason"))
+	if reason == "" {
+		reason = DEFAULT_FLAG_REASON
+	}
+	if len(reason) > MAX_FLAG_REASON_LENGTH {
+		ctx.renderError(w, badRequestError(fmt.Sprintf("Please keep the reason to %d characters or fewer.", MAX_FLAG_REASON_LENGTH), nil))
+		return
+	}
+
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	article, annotations, _, err := ctx.getArticleAndAnnotations(id)
+	if err != nil {
+		ctx.renderError(w, err)
+		return
+	}
+
+	var annotation *AnnotationInfo
+	for _, a := range annotations {
+		if a.AnnotationID == annotation_id {
+			annotation = a
+			break
+		}
+	}
+	if annotation == nil {
+		ctx.renderError(w, badRequestError("Please go back and select an annotation from this article to flag.",
+			fmt.Errorf("missing annotation info: %q", annotation_id)))
+		return
+	}
+
+	if annotation.Flagged {
+		ctx.renderError(w, conflictError(fmt.Sprintf("This mention of %s has already been flagged as incorrect.", annotation.Term)))
+		return
+	}
+
+	if confirm == "true" {
+		if ctx.AccessToken == nil {
+			ctx.renderError(w, unauthorisedError("You must be logged in to flag an annotation.", nil))
+			return
+		}
+		err = ctx.checkCSRF(r)
+		if err != nil {
+			ctx.renderError(w, err)
+			return
+		}
+
+		err = ctx.newClaimWriter(id).Flag(annotation, reason)
+		if err != nil {
+			ctx.renderError(w, err)
+			return
+		}
+
+		http.Redirect(w, r, "../", http.StatusSeeOther)
+		return
+	}
+
+	err = ctx.Templates.ExecuteWriter("flag.html", pongo.Context{
+		"title":          article.Title,
+		"annotation":     annotation,
+		"default_reason": DEFAULT_FLAG_REASON,
+		"max_length":     MAX_FLAG_REASON_LENGTH,
+		"ctx":            ctx,
+	}, w)
+	if err != nil {
+		ctx.renderError(w, err)
+	}
+}
@@ -0,0 +1,213 @@
+//   Copyright 2019 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const HEALTH_PROBE_SPARQL = "ASK { ?s ?p ?o }"
+const SITE_INFO_API_URL = "%s/w/api.php?action=query&meta=siteinfo&format=json"
+
+const DEFAULT_HEALTH_CACHE_SECONDS = 10
+const HEALTH_PROBE_TIMEOUT = 5 * time.Second
+
+const HEALTH_OK = "ok"
+const HEALTH_DEGRADED = "degraded"
+const HEALTH_DOWN = "down"
+
+type dependencyStatus struct {
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	LatencyMS float64   `json:"latency_ms"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+type dependency struct {
+	Name  string
+	Probe func(client *http.Client) error
+
+	lock   sync.Mutex
+	status dependencyStatus
+}
+
+// Runs the probe unless we have a result newer than max_age, so that frequent polling by the
+// orchestrator doesn't turn into load on the query service.
+func (d *dependency) check(client *http.Client, max_age time.Duration) dependencyStatus {
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if !d.status.CheckedAt.IsZero() && time.Since(d.status.CheckedAt) < max_age {
+		return d.status
+	}
+
+	start := time.Now()
+	err := d.Probe(client)
+	d.status = dependencyStatus{
+		Status:    HEALTH_OK,
+		LatencyMS: float64(time.Since(start).Nanoseconds()) / 1e6,
+		CheckedAt: start,
+	}
+	if err != nil {
+		d.status.Status = HEALTH_DOWN
+		d.status.Error = err.Error()
+		logJSON("warning", "dependency check failed", logFields{"dependency": d.Name, "error": err})
+	}
+	return d.status
+}
+
+func probeQueryService(query_service_url string) func(*http.Client) error {
+	return func(client *http.Client) error {
+		req, err := http.NewRequest("GET", query_service_url+"?query="+url.QueryEscape(HEALTH_PROBE_SPARQL), nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Accept", "application/sparql-results+json")
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("unexpected status %s", resp.Status)
+		}
+
+		var result struct {
+			Boolean *bool `json:"boolean"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		if err != nil {
+			return err
+		}
+		if result.Boolean == nil || !*result.Boolean {
+			return fmt.Errorf("query service returned no data")
+		}
+		return nil
+	}
+}
+
+func probeWikibase(wikibase_url string) func(*http.Client) error {
+	return func(client *http.Client) error {
+		resp, err := client.Get(fmt.Sprintf(SITE_INFO_API_URL, wikibase_url))
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("unexpected status %s", resp.Status)
+		}
+
+		var result struct {
+			Query *struct {
+				General map[string]interface{} `json:"general"`
+			} `json:"query"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		if err != nil {
+			return err
+		}
+		if result.Query == nil || result.Query.General == nil {
+			return fmt.Errorf("wikibase API returned no site info")
+		}
+		return nil
+	}
+}
+
+type healthChecker struct {
+	Dependencies      []*dependency
+	MaxAge            time.Duration
+	ReadyWhenDegraded bool
+	Client            *http.Client
+}
+
+func newHealthChecker(config Config) *healthChecker {
+
+	max_age := time.Duration(config.HealthCacheSeconds) * time.Second
+	if config.HealthCacheSeconds == 0 {
+		max_age = DEFAULT_HEALTH_CACHE_SECONDS * time.Second
+	}
+
+	hc := healthChecker{
+		MaxAge:            max_age,
+		ReadyWhenDegraded: config.ReadyWhenDegraded,
+		Client:            &http.Client{Timeout: HEALTH_PROBE_TIMEOUT},
+	}
+
+	for _, instance := range config.Instances {
+		prefix := ""
+		if instance.Name != "" {
+			prefix = instance.Name + "/"
+		}
+		hc.Dependencies = append(hc.Dependencies,
+			&dependency{Name: prefix + "queryservice", Probe: probeQueryService(instance.QueryServiceURL)},
+			&dependency{Name: prefix + "wikibase", Probe: probeWikibase(instance.WikibaseURL)},
+		)
+	}
+
+	return &hc
+}
+
+// Just tells the orchestrator the process is up and serving requests
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": HEALTH_OK})
+}
+
+// Checks we can reach our dependencies. If only some are reachable we're degraded, which is
+// reported as ready only if configured to, as some pages will still work.
+func (hc *healthChecker) readyzHandler(w http.ResponseWriter, r *http.Request) {
+
+	checks := make(map[string]dependencyStatus, len(hc.Dependencies))
+	failed := 0
+	for _, d := range hc.Dependencies {
+		status := d.check(hc.Client, hc.MaxAge)
+		if status.Status != HEALTH_OK {
+			failed += 1
+		}
+		checks[d.Name] = status
+	}
+
+	overall := HEALTH_OK
+	code := http.StatusOK
+	if failed == len(hc.Dependencies) && failed > 0 {
+		overall = HEALTH_DOWN
+		code = http.StatusServiceUnavailable
+	} else if failed > 0 {
+		overall = HEALTH_DEGRADED
+		if !hc.ReadyWhenDegraded {
+			code = http.StatusServiceUnavailable
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(struct {
+		Status string                      `json:"status"`
+		Checks map[string]dependencyStatus `json:"checks"`
+	}{
+		Status: overall,
+		Checks: checks,
+	})
+}
@@ -0,0 +1,151 @@
+//   Copyright 2019 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Logs are written one JSON object per line so they can be picked up by whatever log
+// aggregation the deployment uses.
+type logFields map[string]interface{}
+
+const REDACTED = "REDACTED"
+
+var logLock sync.Mutex
+var logOutput io.Writer = os.Stderr
+
+func logJSON(level string, message string, fields logFields) {
+
+	entry := make(map[string]interface{}, len(fields)+3)
+	for k, v := range fields {
+		// errors don't marshal to anything useful by default
+		if err, ok := v.(error); ok && err != nil {
+			v = err.Error()
+		}
+		entry[k] = v
+	}
+	entry["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	entry["level"] = level
+	entry["msg"] = message
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		data, _ = json.Marshal(map[string]string{
+			"time":  entry["time"].(string),
+			"level": "error",
+			"msg":   fmt.Sprintf("Failed to encode log entry %q: %v", message, err),
+		})
+	}
+
+	logLock.Lock()
+	defer logLock.Unlock()
+	logOutput.Write(append(data, '\n'))
+}
+
+// Used with log.SetOutput so that anything still using the standard logger comes out as JSON too
+type logWriter struct{}
+
+func (lw logWriter) Write(p []byte) (int, error) {
+	logJSON("info", strings.TrimRight(string(p), "\n"), nil)
+	return len(p), nil
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// Records the status code written so we can log it once the handler is done
+type statusRecorder struct {
+	http.ResponseWriter
+	Status int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	if sr.Status == 0 {
+		sr.Status = status
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.Status == 0 {
+		sr.Status = http.StatusOK
+	}
+	return sr.ResponseWriter.Write(b)
+}
+
+func (ctx *ServerContext) Log(level string, message string, fields logFields) {
+
+	if fields == nil {
+		fields = make(logFields, 0)
+	}
+	fields["request_id"] = ctx.RequestID
+	if ctx.Configuration.Name != "" {
+		fields["instance"] = ctx.Configuration.Name
+	}
+	logJSON(level, message, fields)
+}
+
+// Call after each request to the query service or wikibase API, with the time the call started,
+// so we can see where the time in a request goes. This also records the call's metrics.
+func (ctx *ServerContext) logUpstream(service string, call string, start time.Time, err error) {
+
+	duration := time.Since(start)
+	recordUpstreamMetrics(ctx.Configuration.Name, service, call, duration, err)
+
+	fields := logFields{
+		"service":    service,
+		"call":       call,
+		"latency_ms": float64(duration.Nanoseconds()) / 1e6,
+	}
+	level := "info"
+	if err != nil {
+		level = "error"
+		fields["error"] = err
+	}
+	ctx.Log(level, "upstream call", fields)
+}
+
+// Returns a copy of the config that is safe to log
+func (config Config) redacted() Config {
+
+	res := config
+	if res.SessionKey != "" {
+		res.SessionKey = REDACTED
+	}
+	res.Instances = make([]ServerConfig, len(config.Instances))
+	for i, instance := range config.Instances {
+		if instance.OAuthConsumer.Secret != "" {
+			instance.OAuthConsumer.Secret = REDACTED
+		}
+		res.Instances[i] = instance
+	}
+	return res
+}
@@ -15,13 +15,23 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/gob"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -31,10 +41,11 @@ import (
 	"github.com/ContentMine/wikibase"
 )
 
-var store = sessions.NewCookieStore([]byte("SECURECOOKIES_NOT_USED_CURRENTLY"))
-
+// Settings for a single wikibase instance. Each instance is mounted under its own path prefix
+// with its own OAuth consumer and session cookie.
 type ServerConfig struct {
-	Address              string                       `json:"address"`
+	Name                 string                       `json:"name"`
+	Path                 string                       `json:"path"`
 	OAuthConsumer        wikibase.ConsumerInformation `json:"oauth"`
 	WikibaseURL          string                       `json:"wikibase_url"`
 	QueryServiceURL      string                       `json:"queryservice_url"`
@@ -42,13 +53,54 @@ type ServerConfig struct {
 	EntityPrefix         string                       `json:"entity_prefix"`
 	PropertyPrefix       string                       `json:"property_prefix"`
 	PropertyMap          map[string]string            `json:"properties"`
+	DiscoverProperties   bool                         `json:"discover_properties"`
+	PropertyLabels       map[string]string            `json:"property_labels"`
+	PropertyCache        string                       `json:"property_cache"`
+	EditSummary          string                       `json:"edit_summary"`
+	ChangeTag            string                       `json:"change_tag"`
+	Admins               []string                     `json:"admins"`
+	Sandbox              bool                         `json:"sandbox"`
+	GoldStandard         string                       `json:"gold_standard"`
+}
+
+// Set by the Makefile or Docker build, and logged at startup so we know what's running
+var Version = "unknown"
+var Remote = ""
+
+// Settings for the process as a whole. Older config files have a single instance's settings at
+// the top level rather than in a list of instances, and that is still supported.
+type Config struct {
+	Address                string         `json:"address"`
+	Instances              []ServerConfig `json:"instances"`
+	HealthCacheSeconds     int            `json:"health_cache_seconds"`
+	ReadyWhenDegraded      bool           `json:"ready_when_degraded"`
+	UnixSocket             string         `json:"unix_socket"`
+	ShutdownTimeoutSeconds int            `json:"shutdown_timeout_seconds"`
+	TLS                    TLSConfig      `json:"tls"`
+	ThemeDir               string         `json:"theme_dir"`
+	Upstream               UpstreamConfig `json:"upstream"`
+	AuditLog               string         `json:"audit_log"`
+	SessionKey             string         `json:"session_key"`
+	SandboxJournal         string         `json:"sandbox_journal"`
 }
 
 type ServerContext struct {
+	Context       context.Context
 	Configuration ServerConfig
+	Instances     []ServerConfig
 	AccessToken   *oauth.AccessToken
+	Username      string
 	OAuthConsumer *oauth.Consumer
 	CookieSession *sessions.Session
+	RequestID     string
+	Templates     *templateStore
+	Upstream      *upstreamClients
+	Audit         *auditLog
+	Journal       *sandboxJournal
+	Gold          *goldStandard
+	Sandbox       bool
+	Training      bool
+	Maintenance   bool
 }
 
 func init() {
@@ -56,35 +108,202 @@ func init() {
 	gob.Register(&oauth.AccessToken{})
 }
 
-func loadConfig(path string) (ServerConfig, error) {
+func loadConfig(path string) (Config, error) {
+
+	var config Config
+
+	// An empty path means we're configured purely from the environment
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return Config{}, err
+		}
 
-	f, err := os.Open(path)
+		err = json.Unmarshal(data, &config)
+		if err != nil {
+			return Config{}, err
+		}
+
+		if len(config.Instances) == 0 {
+			var instance ServerConfig
+			err = json.Unmarshal(data, &instance)
+			if err != nil {
+				return Config{}, err
+			}
+			config.Instances = []ServerConfig{instance}
+		}
+	}
+
+	err := config.applyEnvironment()
 	if err != nil {
-		return ServerConfig{}, err
+		return Config{}, err
 	}
 
-	var config ServerConfig
-	err = json.NewDecoder(f).Decode(&config)
-	return config, err
+	return config, config.checkInstances()
 }
 
-// Simple wrapper so we can provide server config to each call
-type callWrapper struct {
+func (config Config) checkInstances() error {
+
+	names := make(map[string]bool, len(config.Instances))
+	paths := make(map[string]bool, len(config.Instances))
+	for _, instance := range config.Instances {
+		if len(config.Instances) > 1 && instance.Name == "" {
+			return fmt.Errorf("all instances need a name when there is more than one")
+		}
+		if instance.Path != "" && (!strings.HasPrefix(instance.Path, "/") || strings.HasSuffix(instance.Path, "/")) {
+			return fmt.Errorf("instance %s path should start but not end with /, e.g. /live", instance.Name)
+		}
+		if names[instance.Name] {
+			return fmt.Errorf("instance name %s is used more than once", instance.Name)
+		}
+		if paths[instance.Path] {
+			return fmt.Errorf("instance path %s is used more than once", instance.Path)
+		}
+		names[instance.Name] = true
+		paths[instance.Path] = true
+	}
+	return nil
+}
+
+// The session cookie holds the reviewer's OAuth token and username, so it's both signed and
+// encrypted, with keys derived from session_key.
+const MIN_SESSION_KEY_LENGTH = 32
+
+// Makes sure we have a session key. Without one configured we make a random one, which is safe,
+// but means everyone is logged out whenever we restart.
+func (config *Config) checkSessionKey() error {
+
+	if config.SessionKey == "" {
+		b := make([]byte, MIN_SESSION_KEY_LENGTH)
+		_, err := rand.Read(b)
+		if err != nil {
+			return err
+		}
+		config.SessionKey = hex.EncodeToString(b)
+		logJSON("warning", "no session_key configured, so using a random one; reviewers will be logged out on restart", nil)
+		return nil
+	}
+	if len(config.SessionKey) < MIN_SESSION_KEY_LENGTH {
+		return fmt.Errorf("session_key should be at least %d characters", MIN_SESSION_KEY_LENGTH)
+	}
+	return nil
+}
+
+func (config Config) sessionKeys() (hash_key []byte, block_key []byte) {
+	hash := sha512.Sum512([]byte("hash:" + config.SessionKey))
+	block := sha256.Sum256([]byte("block:" + config.SessionKey))
+	return hash[:], block[:]
+}
+
+// Everything a handler needs that's specific to the instance it's mounted for
+type Instance struct {
 	ServerConfig
-	H func(*ServerContext, http.ResponseWriter, *http.Request)
+	Store     *sessions.CookieStore
+	Instances []ServerConfig
+	Templates *templateStore
+	Upstream  *upstreamClients
+	Audit     *auditLog
+	Journal   *sandboxJournal
+	Gold      *goldStandard
+}
+
+func NewInstance(config ServerConfig, server Config, templates *templateStore, audit *auditLog, journal *sandboxJournal, gold *goldStandard) *Instance {
+
+	hash_key, block_key := server.sessionKeys()
+	store := sessions.NewCookieStore(hash_key, block_key)
+	// Keep each instance's cookie to its own path so logging into one doesn't affect another
+	store.Options.Path = config.Path + "/"
+	// The session holds the OAuth access token, so don't let it go over plain HTTP if we can avoid it
+	store.Options.Secure = server.TLS.Enabled()
+	// Don't send the session along with forms posted from other sites
+	store.Options.SameSite = http.SameSiteLaxMode
+
+	return &Instance{
+		ServerConfig: config,
+		Store:        store,
+		Instances:    server.Instances,
+		Templates:    templates,
+		Upstream:     newUpstreamClients(server.Upstream),
+		Audit:        audit,
+		Journal:      journal,
+		Gold:         gold,
+	}
+}
+
+func (instance *Instance) sessionName() string {
+	if instance.Name == "" {
+		return "session-name"
+	}
+	return "session-" + instance.Name
+}
+
+// Simple wrapper so we can provide server config to each call. Deadline is how long the
+// handler has, including all its upstream calls, before we give up on it.
+type callWrapper struct {
+	*Instance
+	H        func(*ServerContext, http.ResponseWriter, *http.Request)
+	Deadline time.Duration
 }
 
-func (cw callWrapper) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+func (cw callWrapper) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+
+	start := time.Now()
+	w := &statusRecorder{ResponseWriter: rw}
+
+	// Use the ID from a proxy in front of us if there is one so logs can be matched up
+	request_id := r.Header.Get("X-Request-ID")
+	if request_id == "" {
+		request_id = newRequestID()
+	}
+	w.Header().Set("X-Request-ID", request_id)
+
+	// The request's context is cancelled if the client goes away, so anything we do upstream
+	// for this request should hang off it
+	request_ctx, cancel := context.WithTimeout(r.Context(), cw.Deadline)
+	defer cancel()
+
+	ctx := ServerContext{
+		Context:       request_ctx,
+		Configuration: cw.ServerConfig,
+		Instances:     cw.Instances,
+		RequestID:     request_id,
+		Templates:     cw.Templates,
+		Upstream:      cw.Upstream,
+		Audit:         cw.Audit,
+		Journal:       cw.Journal,
+		Gold:          cw.Gold,
+		Maintenance:   cw.Upstream.Down(),
+	}
+
+	defer func() {
+		if w.Status == 0 {
+			w.Status = http.StatusOK
+		}
+		route := ""
+		if current := mux.CurrentRoute(r); current != nil {
+			route, _ = current.GetPathTemplate()
+		}
+		duration := time.Since(start)
+		requestCounter.Inc(ctx.Configuration.Name, route, r.Method, strconv.Itoa(w.Status))
+		requestLatency.Observe(duration.Seconds(), ctx.Configuration.Name, route)
+		ctx.Log("info", "request", logFields{
+			"method":     r.Method,
+			"route":      route,
+			"path":       r.URL.Path,
+			"status":     w.Status,
+			"latency_ms": float64(duration.Nanoseconds()) / 1e6,
+			"user":       ctx.Username,
+		})
+	}()
 
 	// We use the cookie session for storage as we're otherwise stateless, so may as well create
 	// it here once rather than all over the code
-	session, err := store.Get(r, "session-name")
+	session, err := cw.Store.Get(r, cw.sessionName())
 	if session == nil && err != nil {
-		log.Printf("Error getting session: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		ctx.renderError(w, err)
 		return
 	} else if err != nil {
-		log.Printf("We got a session, but it had an error along the way: %v", err)
+		ctx.Log("warning", "We got a session, but it had an error along the way", logFields{"error": err})
 	}
 
 	// The OAuth consumer isn't thread safe, so we need to build one per request
@@ -100,58 +319,182 @@ func (cw callWrapper) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		"oauth_consumer_key": cw.OAuthConsumer.Key,
 	}
 
-	ctx := ServerContext{
-		Configuration: cw.ServerConfig,
-		OAuthConsumer: consumer,
-		CookieSession: session,
-	}
+	ctx.OAuthConsumer = consumer
+	ctx.CookieSession = session
 
 	v := session.Values["auth"]
 	if t, ok := v.(*oauth.AccessToken); ok {
 		ctx.AccessToken = t
+		activeSessions.Seen(ctx.Configuration.Name, t.Token)
+
+		// Sessions from before we had form tokens won't have one yet
+		if ctx.CSRFToken() == "" {
+			err = ctx.newCSRFToken()
+			if err == nil {
+				err = session.Save(r, w)
+			}
+			if err != nil {
+				ctx.renderError(w, err)
+				return
+			}
+		}
+	}
+	if username, ok := session.Values["username"].(string); ok {
+		ctx.Username = username
 	}
+	// Training is a kind of sandbox, so nothing a trainee does is written to the wikibase
+	sandbox, _ := session.Values[SANDBOX_SESSION_KEY].(bool)
+	training, _ := session.Values[TRAINING_SESSION_KEY].(bool)
+	ctx.Training = training
+	ctx.Sandbox = cw.Sandbox || sandbox || training
 
 	cw.H(&ctx, w, r)
 }
 
+func (instance *Instance) addRoutes(r *mux.Router) {
+
+	page := instance.Upstream.Config.PageDeadline()
+	write := instance.Upstream.Config.WriteDeadline()
+
+	r.Handle("/", callWrapper{instance, homeHandler, page})
+	r.Handle("/article/{id:Q[0-9]+}/", callWrapper{instance, articleHandler, page})
+	r.Handle("/article/{id:Q[0-9]+}/review/", callWrapper{instance, reviewHandler, write})
+	r.Handle("/article/{id:Q[0-9]+}/review/term/", callWrapper{instance, termReviewHandler, write})
+	r.Handle("/article/{id:Q[0-9]+}/flag/", callWrapper{instance, flagHandler, write})
+	r.Handle("/article/{id:Q[0-9]+}/annotate/", callWrapper{instance, annotateHandler, write})
+	r.Handle("/article/{id:Q[0-9]+}/basket/", callWrapper{instance, basketHandler, write})
+	r.Handle("/article/{id:Q[0-9]+}/score/", callWrapper{instance, scoreHandler, page})
+
+	r.Handle("/auth/", callWrapper{instance, authHandler, page})
+	r.Handle("/token/", callWrapper{instance, getTokenHandler, page})
+	r.Handle("/deauth/", callWrapper{instance, deauthHandler, page})
+	r.Handle("/sandbox/", callWrapper{instance, sandboxHandler, page})
+	r.Handle("/training/", callWrapper{instance, trainingHandler, page})
+
+	r.Handle("/admin/audit/", callWrapper{instance, auditHandler, page})
+	r.Handle("/admin/gold/", callWrapper{instance, goldHandler, page})
+}
+
 func main() {
 
 	var config_path string
-	flag.StringVar(&config_path, "config", "config.json", "configuration file, required")
+	var dev bool
+	flag.StringVar(&config_path, "config", "config.json", "configuration file, or empty to use only environment variables")
+	flag.BoolVar(&dev, "dev", false, "reload templates from theme_dir when they change, for development")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
+		flag.PrintDefaults()
+		printEnvironmentUsage(flag.CommandLine.Output())
+	}
 	flag.Parse()
 
+	log.SetFlags(0)
+	log.SetOutput(logWriter{})
+
 	config, err := loadConfig(config_path)
 	if err != nil {
 		panic(err)
 	}
-	log.Printf("config: %v", config)
+	logJSON("info", "starting", logFields{"version": Version, "remote": Remote})
+	logJSON("info", "loaded config", logFields{"config": config.redacted()})
+	err = config.checkSessionKey()
+	if err != nil {
+		panic(err)
+	}
 
-	r := mux.NewRouter()
+	for i := range config.Instances {
+		instance := &config.Instances[i]
+		if instance.DiscoverProperties {
+			err = instance.resolvePropertyMap()
+			if err != nil {
+				panic(err)
+			}
+			logJSON("info", "discovered properties", logFields{"instance": instance.Name, "properties": instance.PropertyMap})
+		}
+		err = instance.checkPropertyMap()
+		if err != nil {
+			panic(err)
+		}
+	}
 
-	r.Handle("/", callWrapper{config, homeHandler})
-	r.Handle("/article/{id:Q[0-9]+}/", callWrapper{config, articleHandler})
-	r.Handle("/article/{id:Q[0-9]+}/review/", callWrapper{config, reviewHandler})
+	// Without a theme, -dev works on the templates and static files in the source tree, as
+	// it did before they were embedded
+	theme_dir := config.ThemeDir
+	if dev && theme_dir == "" {
+		theme_dir = "."
+		if _, err := os.Stat(TEMPLATE_DIR); err != nil {
+			logJSON("warning", "-dev with no theme_dir reads templates from the current directory, but there are none here", logFields{"error": err})
+		}
+	}
 
-	r.Handle("/auth/", callWrapper{config, authHandler})
-	r.Handle("/token/", callWrapper{config, getTokenHandler})
-	r.Handle("/deauth/", callWrapper{config, deauthHandler})
+	static_files, err := assetFS(theme_dir, "static")
+	if err != nil {
+		panic(err)
+	}
+	static, err := newStaticAssets(static_files)
+	if err != nil {
+		panic(err)
+	}
 
-	r.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir("./static/"))))
+	template_files, err := assetFS(theme_dir, TEMPLATE_DIR)
+	if err != nil {
+		panic(err)
+	}
+	templates, err := newTemplateStore(template_files, static)
+	if err != nil {
+		panic(err)
+	}
+	if dev {
+		go templates.watch(filepath.Join(theme_dir, TEMPLATE_DIR))
+	}
+
+	audit, err := newAuditLog(config.AuditLog)
+	if err != nil {
+		panic(err)
+	}
+	journal, err := newSandboxJournal(config.SandboxJournal)
+	if err != nil {
+		panic(err)
+	}
+
+	r := mux.NewRouter()
 
-    address := config.Address
-    port := os.Getenv("PORT")
-    if len(port) > 0 {
-        // Running in Heroku, so add port
-        address = "0.0.0.0:" + port
-        log.Printf("Found port, starting on %s", address)
-    }
+	r.Handle("/metrics", http.HandlerFunc(metricsHandler))
+	r.Handle("/healthz", http.HandlerFunc(healthzHandler))
+	r.Handle("/readyz", http.HandlerFunc(newHealthChecker(config).readyzHandler))
+	r.PathPrefix(STATIC_URL_PREFIX).Handler(static)
 
-	srv := &http.Server{
-		Handler:      r,
-		Addr:         config.Address,
-		WriteTimeout: 15 * time.Second,
-		ReadTimeout:  15 * time.Second,
+	// Register the instances with the longest paths first, so an instance mounted at the root
+	// doesn't swallow requests meant for the others
+	instances := make([]ServerConfig, len(config.Instances))
+	copy(instances, config.Instances)
+	sort.SliceStable(instances, func(i, j int) bool {
+		return len(instances[i].Path) > len(instances[j].Path)
+	})
+	for _, instance := range instances {
+		gold, err := newGoldStandard(instance.GoldStandard)
+		if err != nil {
+			panic(err)
+		}
+		if instance.Path == "" {
+			NewInstance(instance, config, templates, audit, journal, gold).addRoutes(r)
+		} else {
+			NewInstance(instance, config, templates, audit, journal, gold).addRoutes(r.PathPrefix(instance.Path).Subrouter())
+		}
+	}
+	// Without an instance at the root send people to the first one listed
+	if instances[len(instances)-1].Path != "" {
+		r.Handle("/", http.RedirectHandler(config.Instances[0].Path+"/", http.StatusTemporaryRedirect))
 	}
 
-	log.Fatal(srv.ListenAndServe())
+	servers, certificates, err := config.servers(r)
+	if err != nil {
+		panic(err)
+	}
+
+	err = config.serve(servers, certificates)
+	if err != nil {
+		log.Fatal(err)
+	}
+	logJSON("info", "shut down cleanly", nil)
 }
@@ -0,0 +1,315 @@
+//   Copyright 2019 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A minimal implementation of the Prometheus text exposition format. We only need counters,
+// histograms and a gauge, which isn't enough to justify pulling in the full client library.
+
+// How long since we last saw a session before we no longer count it as active. Sessions live in
+// cookies, so we have no other way of knowing when one ends.
+const ACTIVE_SESSION_WINDOW = 30 * time.Minute
+const SESSION_PRUNE_INTERVAL = time.Minute
+
+var LATENCY_BUCKETS = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// The wikibase calls that change data, as opposed to fetching tokens and the like
+var WIKIBASE_WRITE_CALLS = map[string]bool{
+	"create_claim":      true,
+	"set_claim":         true,
+	"flag":              true,
+	"create_anchor":     true,
+	"create_annotation": true,
+}
+
+type metric interface {
+	write(buf *bytes.Buffer)
+}
+
+type counterVec struct {
+	Name   string
+	Help   string
+	Labels []string
+
+	lock   sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec(name string, help string, labels ...string) *counterVec {
+	return &counterVec{Name: name, Help: help, Labels: labels, values: make(map[string]float64, 0)}
+}
+
+func (c *counterVec) Inc(label_values ...string) {
+	key := labelKey(c.Labels, label_values)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.values[key] += 1
+}
+
+func (c *counterVec) write(buf *bytes.Buffer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s counter\n", c.Name, c.Help, c.Name)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(buf, "%s{%s} %s\n", c.Name, key, formatFloat(c.values[key]))
+	}
+}
+
+type histogram struct {
+	Counts []uint64
+	Sum    float64
+	Count  uint64
+}
+
+type histogramVec struct {
+	Name    string
+	Help    string
+	Labels  []string
+	Buckets []float64
+
+	lock   sync.Mutex
+	values map[string]*histogram
+}
+
+func newHistogramVec(name string, help string, labels ...string) *histogramVec {
+	return &histogramVec{
+		Name:    name,
+		Help:    help,
+		Labels:  labels,
+		Buckets: LATENCY_BUCKETS,
+		values:  make(map[string]*histogram, 0),
+	}
+}
+
+func (h *histogramVec) Observe(value float64, label_values ...string) {
+	key := labelKey(h.Labels, label_values)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	v, ok := h.values[key]
+	if !ok {
+		v = &histogram{Counts: make([]uint64, len(h.Buckets))}
+		h.values[key] = v
+	}
+	for i, bound := range h.Buckets {
+		if value <= bound {
+			v.Counts[i] += 1
+		}
+	}
+	v.Sum += value
+	v.Count += 1
+}
+
+func (h *histogramVec) write(buf *bytes.Buffer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s histogram\n", h.Name, h.Help, h.Name)
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		v := h.values[key]
+		sep := ""
+		if key != "" {
+			sep = ","
+		}
+		for i, bound := range h.Buckets {
+			fmt.Fprintf(buf, "%s_bucket{%s%sle=\"%s\"} %d\n", h.Name, key, sep, formatFloat(bound), v.Counts[i])
+		}
+		fmt.Fprintf(buf, "%s_bucket{%s%sle=\"+Inf\"} %d\n", h.Name, key, sep, v.Count)
+		fmt.Fprintf(buf, "%s_sum{%s} %s\n", h.Name, key, formatFloat(v.Sum))
+		fmt.Fprintf(buf, "%s_count{%s} %d\n", h.Name, key, v.Count)
+	}
+}
+
+// Keeps track of when we last saw each authenticated session so we can report how many are active
+type sessionTracker struct {
+	Name string
+	Help string
+
+	lock       sync.Mutex
+	lastSeen   map[string]map[string]time.Time
+	lastPruned time.Time
+}
+
+// Sessions are identified by their access token, which is as good as a password, so we only keep
+// a hash of it
+func sessionKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Drops sessions we've not seen within the window. Must be called with the lock held.
+func (s *sessionTracker) prune(now time.Time) {
+	cutoff := now.Add(-ACTIVE_SESSION_WINDOW)
+	for instance, sessions := range s.lastSeen {
+		for session, seen := range sessions {
+			if seen.Before(cutoff) {
+				delete(sessions, session)
+			}
+		}
+		if len(sessions) == 0 {
+			delete(s.lastSeen, instance)
+		}
+	}
+	s.lastPruned = now
+}
+
+// Prunes as we go as well as when scraped, so we don't grow without bound if nobody scrapes us
+func (s *sessionTracker) Seen(instance string, token string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.lastPruned) > SESSION_PRUNE_INTERVAL {
+		s.prune(now)
+	}
+	if s.lastSeen[instance] == nil {
+		s.lastSeen[instance] = make(map[string]time.Time, 0)
+	}
+	s.lastSeen[instance][sessionKey(token)] = now
+}
+
+func (s *sessionTracker) Forget(instance string, token string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.lastSeen[instance], sessionKey(token))
+}
+
+func (s *sessionTracker) write(buf *bytes.Buffer) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.prune(time.Now())
+
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s gauge\n", s.Name, s.Help, s.Name)
+	instances := make([]string, 0, len(s.lastSeen))
+	for instance := range s.lastSeen {
+		instances = append(instances, instance)
+	}
+	sort.Strings(instances)
+
+	for _, instance := range instances {
+		fmt.Fprintf(buf, "%s{%s} %d\n", s.Name, labelKey([]string{"instance"}, []string{instance}), len(s.lastSeen[instance]))
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func labelKey(labels []string, values []string) string {
+	parts := make([]string, len(labels))
+	for i, label := range labels {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		parts[i] = fmt.Sprintf("%s=\"%s\"", label, labelEscaper.Replace(value))
+	}
+	return strings.Join(parts, ",")
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+var (
+	requestCounter = newCounterVec("ssr_http_requests_total",
+		"HTTP requests handled, by route and status.", "instance", "route", "method", "status")
+	requestLatency = newHistogramVec("ssr_http_request_duration_seconds",
+		"Time taken to handle HTTP requests, by route.", "instance", "route")
+	sparqlLatency = newHistogramVec("ssr_sparql_query_duration_seconds",
+		"Time taken by queries to the query service, by kind of query.", "instance", "query")
+	sparqlErrors = newCounterVec("ssr_sparql_query_errors_total",
+		"Queries to the query service that failed, by kind of query.", "instance", "query")
+	wikibaseCalls = newCounterVec("ssr_wikibase_api_calls_total",
+		"Calls to the wikibase API, by call and result.", "instance", "call", "result")
+	wikibaseWrites = newCounterVec("ssr_wikibase_writes_total",
+		"Calls to the wikibase API that change data, by result.", "instance", "call", "result")
+	wikibaseLatency = newHistogramVec("ssr_wikibase_api_call_duration_seconds",
+		"Time taken by calls to the wikibase API.", "instance", "call")
+	oauthLogins = newCounterVec("ssr_oauth_logins_total",
+		"OAuth logins attempted, by result.", "instance", "result")
+	activeSessions = &sessionTracker{
+		Name:     "ssr_active_sessions",
+		Help:     "Authenticated sessions seen in the last 30 minutes.",
+		lastSeen: make(map[string]map[string]time.Time, 0),
+	}
+
+	allMetrics = []metric{
+		requestCounter, requestLatency, sparqlLatency, sparqlErrors,
+		wikibaseCalls, wikibaseWrites, wikibaseLatency, oauthLogins, activeSessions,
+	}
+)
+
+func resultLabel(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+func recordUpstreamMetrics(instance string, service string, call string, duration time.Duration, err error) {
+	switch service {
+	case "sparql":
+		sparqlLatency.Observe(duration.Seconds(), instance, call)
+		if err != nil {
+			sparqlErrors.Inc(instance, call)
+		}
+	case "wikibase":
+		wikibaseLatency.Observe(duration.Seconds(), instance, call)
+		wikibaseCalls.Inc(instance, call, resultLabel(err))
+		if WIKIBASE_WRITE_CALLS[call] {
+			wikibaseWrites.Inc(instance, call, resultLabel(err))
+		}
+	}
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+
+	var buf bytes.Buffer
+	for _, m := range allMetrics {
+		m.write(&buf)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,204 @@
+//   Copyright 2019 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Looks up entities by their English label. Properties and items are both matched, as the
+// property map also holds the item ID for the article class.
+const PROPERTY_LABEL_QUERY_SPARQL = `
+SELECT ?entity ?label WHERE {
+  VALUES ?label { %s }
+  ?entity rdfs:label ?label.
+}
+`
+
+// These are the keys the SPARQL queries and handlers rely on, so we refuse to start if any
+// are missing once the property map has been resolved.
+var REQUIRED_PROPERTIES = []string{
+	"claim", "title", "pageid", "wikidataid", "instanceof", "article", "anchorin",
+	"basedon", "term", "dictionary", "offset", "preceding_phrase", "following_phrase",
+}
+
+// These turn on extra features if they're in the property map, but we can do without them
+var OPTIONAL_PROPERTIES = []string{
+	EVIDENCE_PROPERTY,
+	FLAG_PROPERTY,
+}
+
+// Returned when the labels themselves are at fault, as opposed to the query service being
+// unreachable, so we know not to fall back to a cached map.
+type propertyLabelError struct {
+	Missing   []string
+	Ambiguous map[string][]string
+}
+
+func (e *propertyLabelError) Error() string {
+	parts := make([]string, 0, 2)
+	if len(e.Missing) > 0 {
+		parts = append(parts, fmt.Sprintf("no entity found for labels %v", e.Missing))
+	}
+	if len(e.Ambiguous) > 0 {
+		parts = append(parts, fmt.Sprintf("multiple entities found for labels %v", e.Ambiguous))
+	}
+	return "property discovery failed: " + strings.Join(parts, "; ")
+}
+
+func sparqlStringLiteral(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`)
+	return `"` + r.Replace(s) + `"@en`
+}
+
+// Given a map of property key to label, this will ask the query service which entity has that
+// label and return a map of property key to entity ID (e.g. "P22" or "Q2").
+func discoverPropertyIDs(query_service_url string, entity_prefix string, labels map[string]string) (map[string]string, error) {
+
+	values := make([]string, 0, len(labels))
+	for _, label := range labels {
+		values = append(values, sparqlStringLiteral(label))
+	}
+	sort.Strings(values)
+
+	query := fmt.Sprintf(PROPERTY_LABEL_QUERY_SPARQL, strings.Join(values, " "))
+	ctx, cancel := context.WithTimeout(context.Background(), DEFAULT_UPSTREAM_TIMEOUT_SECONDS*time.Second)
+	defer cancel()
+	resp, err := makeSPARQLQuery(ctx, http.DefaultClient, query_service_url, query)
+	if err != nil {
+		return nil, err
+	}
+
+	found := make(map[string][]string, len(labels))
+	for _, binding := range resp.Results.Bindings {
+		label := binding["label"].Value
+		id := strings.TrimPrefix(binding["entity"].Value, entity_prefix)
+
+		duplicate := false
+		for _, existing := range found[label] {
+			if existing == id {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			found[label] = append(found[label], id)
+		}
+	}
+
+	res := make(map[string]string, len(labels))
+	label_err := propertyLabelError{Ambiguous: make(map[string][]string, 0)}
+	for key, label := range labels {
+		ids := found[label]
+		switch len(ids) {
+		case 0:
+			label_err.Missing = append(label_err.Missing, label)
+		case 1:
+			res[key] = ids[0]
+		default:
+			label_err.Ambiguous[label] = ids
+		}
+	}
+	if len(label_err.Missing) > 0 || len(label_err.Ambiguous) > 0 {
+		sort.Strings(label_err.Missing)
+		return nil, &label_err
+	}
+
+	return res, nil
+}
+
+func loadPropertyCache(path string) (map[string]string, error) {
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var res map[string]string
+	err = json.Unmarshal(data, &res)
+	return res, err
+}
+
+func savePropertyCache(path string, properties map[string]string) error {
+
+	data, err := json.MarshalIndent(properties, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// Fills in the PropertyMap from the configured labels. If the query service can't be reached
+// we use the last successfully discovered map if there is one, but a missing or ambiguous label
+// is always fatal, as guessing would have us write claims against the wrong property.
+func (config *ServerConfig) resolvePropertyMap() error {
+
+	discovered, err := discoverPropertyIDs(config.QueryServiceURL, config.EntityPrefix, config.PropertyLabels)
+	if err != nil {
+		if _, ok := err.(*propertyLabelError); ok || config.PropertyCache == "" {
+			return err
+		}
+		log.Printf("Property discovery failed, falling back to cache %s: %v", config.PropertyCache, err)
+		discovered, err = loadPropertyCache(config.PropertyCache)
+		if err != nil {
+			return fmt.Errorf("failed to load property cache: %v", err)
+		}
+	} else if config.PropertyCache != "" {
+		err = savePropertyCache(config.PropertyCache, discovered)
+		if err != nil {
+			log.Printf("Failed to save property cache %s: %v", config.PropertyCache, err)
+		}
+	}
+
+	if config.PropertyMap == nil {
+		config.PropertyMap = make(map[string]string, len(discovered))
+	}
+	for key, id := range discovered {
+		if existing, ok := config.PropertyMap[key]; ok && existing != id {
+			log.Printf("Discovered %s as %s, replacing configured %s", key, id, existing)
+		}
+		config.PropertyMap[key] = id
+	}
+
+	return nil
+}
+
+func (config ServerConfig) checkPropertyMap() error {
+
+	missing := make([]string, 0)
+	for _, key := range REQUIRED_PROPERTIES {
+		if config.PropertyMap[key] == "" {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("property map for instance %q is missing entries for %v", config.Name, missing)
+	}
+
+	for _, key := range OPTIONAL_PROPERTIES {
+		if config.PropertyMap[key] == "" {
+			logJSON("info", "optional property not configured, some features will be disabled", logFields{"instance": config.Name, "property": key})
+		}
+	}
+	return nil
+}
@@ -0,0 +1,360 @@
+//   Copyright 2019 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const DEFAULT_UPSTREAM_TIMEOUT_SECONDS = 10
+const DEFAULT_UPSTREAM_RETRIES = 2
+const DEFAULT_UPSTREAM_RETRY_DELAY_MS = 200
+const DEFAULT_BREAKER_THRESHOLD = 5
+const DEFAULT_BREAKER_COOLDOWN_SECONDS = 30
+const DEFAULT_PAGE_DEADLINE_SECONDS = 30
+const DEFAULT_WRITE_DEADLINE_SECONDS = 60
+
+// Time after a route's deadline to render the error page and write it out before the server
+// gives up on the connection
+const RESPONSE_TIMEOUT_MARGIN_SECONDS = 10
+
+type UpstreamConfig struct {
+	TimeoutSeconds         int `json:"timeout_seconds"`
+	Retries                int `json:"retries"`
+	RetryDelayMS           int `json:"retry_delay_ms"`
+	BreakerThreshold       int `json:"breaker_threshold"`
+	BreakerCooldownSeconds int `json:"breaker_cooldown_seconds"`
+	PageDeadlineSeconds    int `json:"page_deadline_seconds"`
+	WriteDeadlineSeconds   int `json:"write_deadline_seconds"`
+}
+
+func (config UpstreamConfig) withDefaults() UpstreamConfig {
+	if config.TimeoutSeconds == 0 {
+		config.TimeoutSeconds = DEFAULT_UPSTREAM_TIMEOUT_SECONDS
+	}
+	if config.Retries == 0 {
+		config.Retries = DEFAULT_UPSTREAM_RETRIES
+	}
+	if config.RetryDelayMS == 0 {
+		config.RetryDelayMS = DEFAULT_UPSTREAM_RETRY_DELAY_MS
+	}
+	if config.BreakerThreshold == 0 {
+		config.BreakerThreshold = DEFAULT_BREAKER_THRESHOLD
+	}
+	if config.BreakerCooldownSeconds == 0 {
+		config.BreakerCooldownSeconds = DEFAULT_BREAKER_COOLDOWN_SECONDS
+	}
+	if config.PageDeadlineSeconds == 0 {
+		config.PageDeadlineSeconds = DEFAULT_PAGE_DEADLINE_SECONDS
+	}
+	if config.WriteDeadlineSeconds == 0 {
+		config.WriteDeadlineSeconds = DEFAULT_WRITE_DEADLINE_SECONDS
+	}
+	return config
+}
+
+// How long a whole request may spend, across all its upstream calls and retries, before we give
+// up on it. Pages that write to the wikibase get longer, as they make more calls.
+func (config UpstreamConfig) PageDeadline() time.Duration {
+	return time.Duration(config.PageDeadlineSeconds) * time.Second
+}
+
+func (config UpstreamConfig) WriteDeadline() time.Duration {
+	return time.Duration(config.WriteDeadlineSeconds) * time.Second
+}
+
+// The server's write timeout has to outlast every route's deadline, or it'd drop the connection
+// before we could tell the reviewer what happened, possibly with a write still on its way.
+func (config UpstreamConfig) ResponseTimeout() time.Duration {
+	config = config.withDefaults()
+	deadline := config.PageDeadline()
+	if config.WriteDeadline() > deadline {
+		deadline = config.WriteDeadline()
+	}
+	return deadline + RESPONSE_TIMEOUT_MARGIN_SECONDS*time.Second
+}
+
+var errCircuitOpen = errors.New("circuit breaker open")
+
+// Whether an error means the service couldn't be reached or was too busy to answer, as opposed
+// to it telling us our request was wrong. Only these are worth retrying, and only these count
+// towards tripping the circuit breaker.
+func isUnavailable(err error) bool {
+
+	if errors.Is(err, errCircuitOpen) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var net_err net.Error
+	if errors.As(err, &net_err) {
+		return true
+	}
+
+	var status_err *httpStatusError
+	if errors.As(err, &status_err) {
+		switch status_err.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout, http.StatusTooManyRequests:
+			return true
+		}
+	}
+
+	return false
+}
+
+// After Threshold consecutive failures to reach a service we stop trying for Cooldown, failing
+// requests straight away rather than have every reviewer wait on timeouts. Once the cooldown
+// has passed we let a single request through to see if the service is back.
+type circuitBreaker struct {
+	Threshold int
+	Cooldown  time.Duration
+
+	lock     sync.Mutex
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// Also says whether the call is the probe, which must be passed back to Record or Release so that only the
+// probe's outcome lets another one through
+func (cb *circuitBreaker) Allow() (allowed bool, probe bool) {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+
+	if cb.failures < cb.Threshold {
+		return true, false
+	}
+	if cb.probing || time.Since(cb.openedAt) < cb.Cooldown {
+		return false, false
+	}
+	cb.probing = true
+	return true, true
+}
+
+func (cb *circuitBreaker) Record(err error, probe bool) {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+
+	if probe {
+		cb.probing = false
+	}
+	if err == nil || !isUnavailable(err) {
+		cb.failures = 0
+		return
+	}
+
+	cb.failures += 1
+	if cb.failures >= cb.Threshold {
+		cb.openedAt = time.Now()
+	}
+}
+
+// Lets the breaker allow another probe without recording anything, for when a call was
+// abandoned before we learned whether the service is back
+func (cb *circuitBreaker) Release(probe bool) {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	if probe {
+		cb.probing = false
+	}
+}
+
+func (cb *circuitBreaker) IsOpen() bool {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	return cb.failures >= cb.Threshold
+}
+
+// The per instance state for talking to the query service and wikibase API
+type upstreamClients struct {
+	Config     UpstreamConfig
+	HTTPClient *http.Client
+	Breakers   map[string]*circuitBreaker
+}
+
+func newUpstreamClients(config UpstreamConfig) *upstreamClients {
+
+	config = config.withDefaults()
+	cooldown := time.Duration(config.BreakerCooldownSeconds) * time.Second
+
+	return &upstreamClients{
+		Config:     config,
+		HTTPClient: &http.Client{},
+		Breakers: map[string]*circuitBreaker{
+			"sparql":   {Threshold: config.BreakerThreshold, Cooldown: cooldown},
+			"wikibase": {Threshold: config.BreakerThreshold, Cooldown: cooldown},
+		},
+	}
+}
+
+func (uc *upstreamClients) Down() bool {
+	for _, breaker := range uc.Breakers {
+		if breaker.IsOpen() {
+			return true
+		}
+	}
+	return false
+}
+
+// Sends every request under the given context, for libraries that make their own requests and
+// don't take one. Giving up on the context then cancels the request itself.
+type contextTransport struct {
+	ctx  context.Context
+	base http.RoundTripper
+}
+
+func (t *contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.base.RoundTrip(req.WithContext(t.ctx))
+}
+
+// The OAuth library doesn't take a context, but makes its requests with the consumer's HTTP
+// client, so for the duration of f we give it one bound to the request's context.
+func (ctx *ServerContext) withOAuthContext(f func() error) error {
+	client := ctx.OAuthConsumer.HttpClient
+	ctx.OAuthConsumer.HttpClient = &http.Client{Transport: &contextTransport{ctx: ctx.Context, base: http.DefaultTransport}}
+	defer func() {
+		ctx.OAuthConsumer.HttpClient = client
+	}()
+	return f()
+}
+
+// Runs independent fetches at the same time, so a page waits for the slowest rather than all of
+// them in turn. Each gets its own copy of the context so that as soon as one fails the others are
+// cancelled, as the page can't be shown anyway. The error returned is the first one to happen, as
+// the others are most likely just us cancelling them; any others are logged.
+func (ctx *ServerContext) fetchAll(fetches ...func(*ServerContext) error) error {
+
+	group_ctx, cancel := context.WithCancel(ctx.Context)
+	defer cancel()
+
+	type result struct {
+		index int
+		err   error
+	}
+	results := make(chan result, len(fetches))
+
+	for i, fetch := range fetches {
+		fetch_ctx := *ctx
+		fetch_ctx.Context = group_ctx
+		go func(i int, fetch func(*ServerContext) error) {
+			results <- result{i, fetch(&fetch_ctx)}
+		}(i, fetch)
+	}
+
+	var first error
+	for range fetches {
+		res := <-results
+		if res.err == nil {
+			continue
+		}
+		if first == nil {
+			first = res.err
+			cancel()
+		} else if !errors.Is(res.err, context.Canceled) {
+			ctx.Log("warning", "Another fetch failed too", logFields{"error": res.err, "fetch": res.index})
+		}
+	}
+
+	return first
+}
+
+// Makes a call to an upstream service with a timeout, going through its circuit breaker. Calls
+// marked idempotent are retried with exponential backoff and jitter if the service can't be
+// reached; writes never are, as the first attempt may have succeeded even if we didn't hear
+// back. Each call is made under the request's context, so if the reviewer goes away or the
+// route's deadline passes we stop waiting on the service. The returned error has been through
+// upstreamError, so is ready to show to the user.
+func (ctx *ServerContext) callUpstream(service string, call string, idempotent bool, f func(context.Context) error) error {
+
+	config := ctx.Upstream.Config
+	breaker := ctx.Upstream.Breakers[service]
+
+	attempts := 1
+	if idempotent {
+		attempts += config.Retries
+	}
+
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+
+		if attempt > 0 {
+			delay := time.Duration(config.RetryDelayMS) * time.Millisecond << uint(attempt-1)
+			timer := time.NewTimer(time.Duration(float64(delay) * (0.5 + rand.Float64())))
+			select {
+			case <-timer.C:
+			case <-ctx.Context.Done():
+				timer.Stop()
+			}
+		}
+
+		// No point trying again if the request is over
+		if ctx.Context.Err() != nil {
+			err = ctx.Context.Err()
+			break
+		}
+
+		allowed, probe := breaker.Allow()
+		if !allowed {
+			err = errCircuitOpen
+			break
+		}
+
+		start := time.Now()
+		call_ctx, cancel := context.WithTimeout(ctx.Context, time.Duration(config.TimeoutSeconds)*time.Second)
+		err = f(call_ctx)
+		cancel()
+		ctx.logUpstream(service, call, start, err)
+
+		// If we gave up because of the request rather than the service, that says nothing
+		// about the health of the service, so don't let it count towards the breaker
+		if ctx.Context.Err() != nil {
+			breaker.Release(probe)
+			err = ctx.Context.Err()
+			break
+		}
+		breaker.Record(err, probe)
+
+		if err == nil || !isUnavailable(err) {
+			break
+		}
+	}
+
+	if ctx.Context.Err() != nil {
+		return requestContextError(ctx.Context.Err())
+	}
+	return upstreamError(SERVICE_NAMES[service], err)
+}
+
+// Used in messages to the user
+var SERVICE_NAMES = map[string]string{
+	"sparql":   "query service",
+	"wikibase": "wikibase",
+}
+
+func (ctx *ServerContext) querySPARQL(call string, query string) (*SPARQLResponse, error) {
+
+	var resp *SPARQLResponse
+	err := ctx.callUpstream("sparql", call, true, func(call_ctx context.Context) error {
+		var err error
+		resp, err = makeSPARQLQuery(call_ctx, ctx.Upstream.HTTPClient, ctx.Configuration.QueryServiceURL, query)
+		return err
+	})
+	return resp, err
+}
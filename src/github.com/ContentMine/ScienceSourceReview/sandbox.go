@@ -0,0 +1,439 @@
+//   Copyright 2019 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ContentMine/wikibase"
+)
+
+// In sandbox mode, used for training workshops, writes go to a local journal rather than the
+// wikibase. When reading articles we lay the reviewer's journalled edits over what the query
+// service tells us, so the tool behaves as if they'd really been made.
+
+const SANDBOX_SESSION_KEY = "sandbox"
+
+// Items made in the sandbox get IDs that can't be mistaken for real ones
+const SANDBOX_ID_PREFIX = "S"
+
+// Training edits are kept apart from sandbox practice so they can be scored on their own. Each
+// attempt at a training article is numbered, and starting the article again is recorded in the
+// journal as a reset, which begins a new attempt. Entries from before we had modes count as
+// sandbox ones.
+const JOURNAL_MODE_SANDBOX = "sandbox"
+const JOURNAL_MODE_TRAINING = "training"
+const JOURNAL_RESET_CALL = "reset"
+
+type journalEntry struct {
+	Time     time.Time         `json:"time"`
+	Instance string            `json:"instance"`
+	User     string            `json:"user"`
+	Article  string            `json:"article"`
+	Call     string            `json:"call"`
+	Form     map[string]string `json:"form"`
+	NewID    string            `json:"new_id,omitempty"`
+	Mode     string            `json:"mode,omitempty"`
+	Attempt  int               `json:"attempt,omitempty"`
+}
+
+func (entry journalEntry) mode() string {
+	if entry.Mode == "" {
+		return JOURNAL_MODE_SANDBOX
+	}
+	return entry.Mode
+}
+
+func (ctx *ServerContext) journalMode() string {
+	if ctx.Training {
+		return JOURNAL_MODE_TRAINING
+	}
+	return JOURNAL_MODE_SANDBOX
+}
+
+type sandboxJournal struct {
+	Path string
+
+	lock    sync.RWMutex
+	entries []journalEntry
+	next_id int
+}
+
+// Loads any existing journal, so sandbox edits survive a restart. With no path the journal is
+// only kept in memory.
+func newSandboxJournal(path string) (*sandboxJournal, error) {
+
+	journal := &sandboxJournal{Path: path, next_id: 1}
+	if path == "" {
+		return journal, nil
+	}
+
+	f, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry journalEntry
+		if json.Unmarshal(scanner.Bytes(), &entry) != nil {
+			continue
+		}
+		journal.entries = append(journal.entries, entry)
+		if entry.NewID != "" {
+			journal.next_id += 1
+		}
+	}
+	return journal, scanner.Err()
+}
+
+// Stands in for the wikibase API, filling in res as if the call had worked
+func (j *sandboxJournal) Record(ctx *ServerContext, call string, article string, form url.Values, res *wikibaseAPIResponse) error {
+
+	entry := journalEntry{
+		Time:     time.Now().UTC(),
+		Instance: ctx.Configuration.Name,
+		User:     ctx.Username,
+		Article:  article,
+		Call:     call,
+		Form:     make(map[string]string, len(form)),
+		Mode:     ctx.journalMode(),
+	}
+	for key := range form {
+		if key != "token" {
+			entry.Form[key] = form.Get(key)
+		}
+	}
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if form.Get("new") != "" {
+		entry.NewID = fmt.Sprintf("%s%d", SANDBOX_ID_PREFIX, j.next_id)
+	}
+	if entry.Mode == JOURNAL_MODE_TRAINING {
+		entry.Attempt = j.attempts(entry.Instance, entry.User)[article]
+	}
+
+	err := j.append(entry)
+	if err != nil {
+		return err
+	}
+
+	res.Success = 1
+	if entry.NewID != "" {
+		res.Entity = &struct {
+			ID        string `json:"id"`
+			LastRevID int    `json:"lastrevid"`
+		}{ID: entry.NewID}
+	}
+	ctx.Log("info", "Recorded sandbox edit", logFields{"call": call, "article": article, "new_id": entry.NewID})
+	return nil
+}
+
+// Must be called with the lock held
+func (j *sandboxJournal) append(entry journalEntry) error {
+
+	if j.Path != "" {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		f, err := os.OpenFile(j.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(append(line, '\n'))
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	j.entries = append(j.entries, entry)
+	if entry.NewID != "" {
+		j.next_id += 1
+	}
+	return nil
+}
+
+// The current training attempt at each article, which goes up by one with each reset. Articles
+// not in the map are on their first attempt, which is 0. Must be called with the lock held.
+func (j *sandboxJournal) attempts(instance string, user string) map[string]int {
+
+	res := make(map[string]int, 0)
+	for _, entry := range j.entries {
+		if entry.Instance == instance && entry.User == user && entry.Call == JOURNAL_RESET_CALL {
+			// Resets are tagged with the attempt they ended
+			res[entry.Article] = entry.Attempt + 1
+		}
+	}
+	return res
+}
+
+// Starts a new training attempt at the article, so the reviewer's earlier picks there no longer
+// show or count
+func (j *sandboxJournal) Reset(ctx *ServerContext, article string) error {
+
+	// Otherwise we'd reset every anonymous trainee's attempt
+	if ctx.Username == "" {
+		return unauthorisedError("We couldn't tell who you are, so can't start the article again. Please log in again.", nil)
+	}
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	attempt := j.attempts(ctx.Configuration.Name, ctx.Username)[article]
+	ctx.Log("info", "Reset training attempt", logFields{"article": article, "attempt": attempt})
+	return j.append(journalEntry{
+		Time:     time.Now().UTC(),
+		Instance: ctx.Configuration.Name,
+		User:     ctx.Username,
+		Article:  article,
+		Call:     JOURNAL_RESET_CALL,
+		Mode:     JOURNAL_MODE_TRAINING,
+		Attempt:  attempt,
+	})
+}
+
+// The reviewer's edits in the given mode. For training that's only the current attempt at each
+// article.
+func (j *sandboxJournal) entriesFor(instance string, user string, mode string) []journalEntry {
+
+	j.lock.RLock()
+	defer j.lock.RUnlock()
+
+	attempts := j.attempts(instance, user)
+	res := make([]journalEntry, 0)
+	for _, entry := range j.entries {
+		if entry.Instance != instance || entry.User != user || entry.Call == JOURNAL_RESET_CALL || entry.mode() != mode {
+			continue
+		}
+		if mode == JOURNAL_MODE_TRAINING && entry.Attempt != attempts[entry.Article] {
+			continue
+		}
+		res = append(res, entry)
+	}
+	return res
+}
+
+type sandboxStatement struct {
+	Entity   string
+	Property string
+	Value    string
+}
+
+// Turns the journalled API calls back into the statements they would have made
+func sandboxStatements(entries []journalEntry) []sandboxStatement {
+
+	statements := make([]sandboxStatement, 0)
+	for _, entry := range entries {
+		switch entry.Form["action"] {
+
+		case "wbcreateclaim":
+			var snak wikibaseSnak
+			var value interface{}
+			if json.Unmarshal([]byte(entry.Form["value"]), &value) != nil {
+				continue
+			}
+			snak.DataValue.Value = value
+			statements = append(statements, sandboxStatement{
+				Entity:   entry.Form["entity"],
+				Property: entry.Form["property"],
+				Value:    snakValue(snak),
+			})
+
+		case "wbsetclaim":
+			var statement wikibaseStatement
+			if json.Unmarshal([]byte(entry.Form["claim"]), &statement) != nil {
+				continue
+			}
+			statements = append(statements, sandboxStatement{
+				Entity:   strings.SplitN(statement.ID, "$", 2)[0],
+				Property: statement.MainSnak.Property,
+				Value:    snakValue(statement.MainSnak),
+			})
+
+		case "wbeditentity":
+			var data struct {
+				Claims []wikibaseStatement `json:"claims"`
+			}
+			if entry.NewID == "" || json.Unmarshal([]byte(entry.Form["data"]), &data) != nil {
+				continue
+			}
+			for _, statement := range data.Claims {
+				statements = append(statements, sandboxStatement{
+					Entity:   entry.NewID,
+					Property: statement.MainSnak.Property,
+					Value:    snakValue(statement.MainSnak),
+				})
+			}
+		}
+	}
+	return statements
+}
+
+// Adds the reviewer's sandbox edits to an article's annotations: new annotations, claims and
+// flags. Annotations are re-sorted as the query would have returned them, by term then position.
+func (ctx *ServerContext) applySandbox(article_id string, annotations []*AnnotationInfo, summaries map[string]AnnotationSummaryInfo) []*AnnotationInfo {
+
+	statements := sandboxStatements(ctx.Journal.entriesFor(ctx.Configuration.Name, ctx.Username, ctx.journalMode()))
+	if len(statements) == 0 {
+		return annotations
+	}
+
+	properties := ctx.Configuration.PropertyMap
+	items := make(map[string]map[string]string, 0)
+	for _, statement := range statements {
+		if strings.HasPrefix(statement.Entity, SANDBOX_ID_PREFIX) {
+			if items[statement.Entity] == nil {
+				items[statement.Entity] = make(map[string]string, 0)
+			}
+			items[statement.Entity][statement.Property] = statement.Value
+		}
+	}
+
+	// Anchors in this article, whether real or made in the sandbox
+	anchors := make(map[string]map[string]string, 0)
+	for _, annotation := range annotations {
+		anchors[string(annotation.AnchorID)] = map[string]string{
+			properties["offset"]:           annotation.Offset,
+			properties["preceding_phrase"]: annotation.PrecedingPhrase,
+			properties["following_phrase"]: annotation.FollowingPhrase,
+		}
+	}
+	for id, values := range items {
+		if values[properties["anchorin"]] == article_id {
+			anchors[id] = values
+		}
+	}
+
+	ids := make([]string, 0, len(items))
+	for id := range items {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	lookup := make(map[wikibase.ItemPropertyType]*AnnotationInfo, len(annotations))
+	for _, annotation := range annotations {
+		lookup[annotation.AnnotationID] = annotation
+	}
+
+	for _, id := range ids {
+		values := items[id]
+		anchor, ok := anchors[values[properties["basedon"]]]
+		if !ok || values[properties["term"]] == "" {
+			continue
+		}
+		annotation := &AnnotationInfo{
+			AnchorID:        wikibase.ItemPropertyType(values[properties["basedon"]]),
+			AnnotationID:    wikibase.ItemPropertyType(id),
+			Term:            values[properties["term"]],
+			Dictionary:      values[properties["dictionary"]],
+			WikidataID:      values[properties["wikidataid"]],
+			Offset:          anchor[properties["offset"]],
+			PrecedingPhrase: anchor[properties["preceding_phrase"]],
+			FollowingPhrase: anchor[properties["following_phrase"]],
+			Claims:          make([]wikibase.ItemPropertyType, 0),
+			Sandbox:         true,
+		}
+		annotations = append(annotations, annotation)
+		lookup[annotation.AnnotationID] = annotation
+
+		summary, ok := summaries[annotation.Term]
+		if ok {
+			summary.Count += 1
+		} else {
+			summary = AnnotationSummaryInfo{WikidataID: annotation.WikidataID, Dictionary: annotation.Dictionary, Count: 1}
+		}
+		summaries[annotation.Term] = summary
+	}
+
+	for _, statement := range statements {
+		annotation, ok := lookup[wikibase.ItemPropertyType(statement.Entity)]
+		if !ok {
+			continue
+		}
+		switch statement.Property {
+		case properties[CLAIM_PROPERTY]:
+			target := wikibase.ItemPropertyType(statement.Value)
+			if !containsItem(annotation.Claims, target) {
+				annotation.Claims = append(annotation.Claims, target)
+			}
+		case properties[FLAG_PROPERTY]:
+			annotation.Flagged = true
+			if !containsString(annotation.FlagReasons, statement.Value) {
+				annotation.FlagReasons = append(annotation.FlagReasons, statement.Value)
+			}
+		}
+	}
+
+	sort.SliceStable(annotations, func(i, j int) bool {
+		if annotations[i].Term != annotations[j].Term {
+			return annotations[i].Term < annotations[j].Term
+		}
+		offset_i, _ := annotationOffset(annotations[i])
+		offset_j, _ := annotationOffset(annotations[j])
+		return offset_i < offset_j
+	})
+
+	return annotations
+}
+
+// Lets a reviewer turn sandbox mode on and off for their session, unless the instance is always
+// in sandbox mode
+func sandboxHandler(ctx *ServerContext, w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if ctx.Configuration.Sandbox {
+		ctx.renderError(w, badRequestError("This Science Source instance is always in sandbox mode.", nil))
+		return
+	}
+	if ctx.AccessToken == nil {
+		ctx.renderError(w, unauthorisedError("You must be logged in to use the sandbox.", nil))
+		return
+	}
+	err := ctx.checkCSRF(r)
+	if err != nil {
+		ctx.renderError(w, err)
+		return
+	}
+
+	ctx.CookieSession.Values[SANDBOX_SESSION_KEY] = r.FormValue("sandbox") == "on"
+	err = ctx.CookieSession.Save(r, w)
+	if err != nil {
+		ctx.renderError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, ctx.Configuration.Path+"/", http.StatusSeeOther)
+}
@@ -0,0 +1,193 @@
+//   Copyright 2019 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const DEFAULT_SHUTDOWN_TIMEOUT_SECONDS = 30
+
+// Works out where we should listen. A Unix socket takes priority, for when we're run as a sidecar
+// behind a proxy, then $PORT, for Heroku style hosting, then the configured address.
+func (config Config) listen() (net.Listener, error) {
+
+	if config.UnixSocket != "" {
+		// A socket left behind by a previous run that didn't exit cleanly would stop us binding
+		err := os.Remove(config.UnixSocket)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		listener, err := net.Listen("unix", config.UnixSocket)
+		if err != nil {
+			return nil, err
+		}
+		err = os.Chmod(config.UnixSocket, 0660)
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+		return listener, nil
+	}
+
+	address := config.Address
+	port := os.Getenv("PORT")
+	if len(port) > 0 {
+		// Running in Heroku, so add port
+		address = "0.0.0.0:" + port
+	}
+
+	return net.Listen("tcp", address)
+}
+
+// A server along with the listener it should serve on
+type listeningServer struct {
+	Server   *http.Server
+	Listener net.Listener
+}
+
+// Sets up the main server, wrapped in TLS if configured, and if asked for, a plain HTTP server
+// that redirects to it. The certificate store is nil unless TLS is enabled.
+func (config Config) servers(handler http.Handler) ([]listeningServer, *certificateStore, error) {
+
+	listener, err := config.listen()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	servers := []listeningServer{{
+		Server: &http.Server{
+			Handler:      handler,
+			WriteTimeout: config.Upstream.ResponseTimeout(),
+			ReadTimeout:  15 * time.Second,
+		},
+		Listener: listener,
+	}}
+
+	if !config.TLS.Enabled() {
+		return servers, nil, nil
+	}
+
+	certificates, err := newCertificateStore(config.TLS.Certificate, config.TLS.PrivateKey)
+	if err != nil {
+		listener.Close()
+		return nil, nil, err
+	}
+	tls_config, err := config.TLS.tlsConfig(certificates)
+	if err != nil {
+		listener.Close()
+		return nil, nil, err
+	}
+	servers[0].Server.TLSConfig = tls_config
+	servers[0].Listener = tls.NewListener(listener, tls_config)
+
+	if config.TLS.RedirectAddress != "" {
+		redirect_listener, err := net.Listen("tcp", config.TLS.RedirectAddress)
+		if err != nil {
+			listener.Close()
+			return nil, nil, err
+		}
+
+		https_port := "443"
+		if _, port, err := net.SplitHostPort(listener.Addr().String()); err == nil {
+			https_port = port
+		}
+
+		servers = append(servers, listeningServer{
+			Server: &http.Server{
+				// Only ever redirects, so has no upstream deadlines to wait out
+				Handler:      httpsRedirectHandler(https_port),
+				WriteTimeout: 15 * time.Second,
+				ReadTimeout:  15 * time.Second,
+			},
+			Listener: redirect_listener,
+		})
+	}
+
+	return servers, certificates, nil
+}
+
+// Serves until we get SIGINT or SIGTERM, then stops accepting new connections and waits for those
+// in flight to finish, so that a reviewer mid way through recording a claim doesn't lose it
+// when we're redeployed. If we're serving TLS then SIGHUP reloads the certificate.
+func (config Config) serve(servers []listeningServer, certificates *certificateStore) error {
+
+	timeout := time.Duration(config.ShutdownTimeoutSeconds) * time.Second
+	if config.ShutdownTimeoutSeconds == 0 {
+		timeout = DEFAULT_SHUTDOWN_TIMEOUT_SECONDS * time.Second
+	}
+
+	errs := make(chan error, len(servers))
+	for _, ls := range servers {
+		logJSON("info", "listening", logFields{"address": ls.Listener.Addr().String()})
+		go func(ls listeningServer) {
+			errs <- ls.Server.Serve(ls.Listener)
+		}(ls)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	if certificates != nil {
+		signal.Notify(signals, syscall.SIGHUP)
+	}
+	defer signal.Stop(signals)
+
+	for stopping := false; !stopping; {
+		select {
+		case err := <-errs:
+			return err
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				err := certificates.reload()
+				if err != nil {
+					logJSON("error", "failed to reload certificate, still using previous one", logFields{"error": err})
+				} else {
+					logJSON("info", "reloaded certificate", nil)
+				}
+				continue
+			}
+			logJSON("info", "shutting down", logFields{"signal": sig.String(), "timeout_seconds": timeout.Seconds()})
+			stopping = true
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var res error
+	for _, ls := range servers {
+		err := ls.Server.Shutdown(ctx)
+		if err != nil && res == nil {
+			res = err
+		}
+	}
+
+	// Serve returns ErrServerClosed as soon as Shutdown is called, which isn't an error for us
+	for range servers {
+		err := <-errs
+		if err != http.ErrServerClosed && res == nil {
+			res = err
+		}
+	}
+	return res
+}
@@ -0,0 +1,88 @@
+//   Copyright 2019 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Our own query service client rather than wikibase.MakeSPARQLQuery, so that we can control
+// timeouts and cancellation, and tell apart the ways a query can fail.
+
+type SPARQLValue struct {
+	Type     string `json:"type"`
+	Value    string `json:"value"`
+	DataType string `json:"datatype,omitempty"`
+	Language string `json:"xml:lang,omitempty"`
+}
+
+type SPARQLResponse struct {
+	Head struct {
+		Vars []string `json:"vars"`
+	} `json:"head"`
+	Results struct {
+		Bindings []map[string]SPARQLValue `json:"bindings"`
+	} `json:"results"`
+	Boolean *bool `json:"boolean,omitempty"`
+}
+
+// The upstream service answered, but not with a success
+type httpStatusError struct {
+	StatusCode int
+	Status     string
+	Body       string
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("unexpected status %s: %s", e.Status, e.Body)
+}
+
+// Queries are sent as POST, as some of ours are long enough to upset proxies as a GET
+func makeSPARQLQuery(ctx context.Context, client *http.Client, service_url string, query string) (*SPARQLResponse, error) {
+
+	form := url.Values{"query": []string{query}, "format": []string{"json"}}
+	req, err := http.NewRequest("POST", service_url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/sparql-results+json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, &httpStatusError{StatusCode: resp.StatusCode, Status: resp.Status, Body: string(body)}
+	}
+
+	var res SPARQLResponse
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
@@ -0,0 +1,153 @@
+//   Copyright 2019 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	pongo "github.com/flosch/pongo2"
+)
+
+const TEMPLATE_DIR = "templates"
+const TEMPLATE_EXTENSION = ".html"
+const TEMPLATE_WATCH_INTERVAL = time.Second
+
+// Lets pongo load templates from the embedded files, or the theme directory layered over them
+type fsLoader struct {
+	Files fs.FS
+}
+
+func (l fsLoader) Abs(base string, name string) string {
+	if path.IsAbs(name) {
+		return strings.TrimPrefix(path.Clean(name), "/")
+	}
+	return path.Join(path.Dir(base), name)
+}
+
+func (l fsLoader) Get(name string) (io.Reader, error) {
+	data, err := fs.ReadFile(l.Files, name)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(data), nil
+}
+
+// All the templates, parsed once at startup so that a broken template stops us starting rather
+// than failing on a request, and so we're not reparsing them for every page.
+type templateStore struct {
+	Files  fs.FS
+	Static *staticAssets
+
+	lock      sync.RWMutex
+	templates map[string]*pongo.Template
+}
+
+func loadTemplates(files fs.FS, static *staticAssets) (map[string]*pongo.Template, error) {
+
+	set := pongo.NewSet("templates", fsLoader{Files: files})
+	set.Globals["static"] = static.URL
+
+	entries, err := fs.ReadDir(files, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	templates := make(map[string]*pongo.Template, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), TEMPLATE_EXTENSION) {
+			continue
+		}
+		t, err := set.FromFile(entry.Name())
+		if err != nil {
+			return nil, fmt.Errorf("failed to load template %s: %v", entry.Name(), err)
+		}
+		templates[entry.Name()] = t
+	}
+
+	return templates, nil
+}
+
+func newTemplateStore(files fs.FS, static *staticAssets) (*templateStore, error) {
+
+	templates, err := loadTemplates(files, static)
+	if err != nil {
+		return nil, err
+	}
+	return &templateStore{Files: files, Static: static, templates: templates}, nil
+}
+
+func (ts *templateStore) ExecuteWriter(name string, context pongo.Context, w io.Writer) error {
+
+	ts.lock.RLock()
+	t, ok := ts.templates[name]
+	ts.lock.RUnlock()
+
+	if !ok {
+		return fmt.Errorf("no template named %s", name)
+	}
+	return t.ExecuteWriter(context, w)
+}
+
+func latestModification(dir string) (time.Time, int, error) {
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+
+	var latest time.Time
+	for _, file := range files {
+		if file.ModTime().After(latest) {
+			latest = file.ModTime()
+		}
+	}
+	return latest, len(files), nil
+}
+
+// For development, reloads the templates whenever a file in the given directory changes, which
+// is the theme directory or the source tree rather than the embedded copies. We just poll,
+// as it's only for development and saves taking on a file notification dependency. If the
+// changed templates don't parse we log why and keep using the previous ones.
+func (ts *templateStore) watch(dir string) {
+
+	last_modified, last_count, _ := latestModification(dir)
+	for range time.Tick(TEMPLATE_WATCH_INTERVAL) {
+		modified, count, err := latestModification(dir)
+		if err != nil || (modified.Equal(last_modified) && count == last_count) {
+			continue
+		}
+		last_modified = modified
+		last_count = count
+
+		templates, err := loadTemplates(ts.Files, ts.Static)
+		if err != nil {
+			logJSON("error", "failed to reload templates", logFields{"error": err})
+			continue
+		}
+
+		ts.lock.Lock()
+		ts.templates = templates
+		ts.lock.Unlock()
+		logJSON("info", "reloaded templates", logFields{"dir": dir})
+	}
+}
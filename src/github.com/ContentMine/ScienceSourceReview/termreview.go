@@ -0,0 +1,293 @@
+//   Copyright 2019 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	pongo "github.com/flosch/pongo2"
+	"github.com/gorilla/mux"
+)
+
+// Reviewing at the term level lets someone say "drug X treats disease Y" once for the paper,
+// rather than picking one of the many places each term is mentioned. The claim goes on a
+// canonical annotation for each term, and the anchors where the two terms appear close together
+// are recorded against it as evidence.
+
+// The property used in a claim's references to point at its supporting anchors. Term level
+// review is only offered if this is in the property map.
+const EVIDENCE_PROPERTY = "evidence"
+
+// Anchors this close together count as supporting a claim. This matches the proximity graph.
+const EVIDENCE_DISTANCE = 200
+
+// All the annotations in an article for the same term
+type TermGroup struct {
+	Key         string
+	Term        string
+	WikidataID  string
+	Dictionary  string
+	Annotations []*AnnotationInfo
+}
+
+// The earliest mention of the term, which is where the claim goes. Annotations without a usable
+// offset are only picked if none of them have one.
+func (g *TermGroup) Canonical() *AnnotationInfo {
+
+	canonical := g.Annotations[0]
+	canonical_offset, canonical_ok := annotationOffset(canonical)
+	for _, annotation := range g.Annotations[1:] {
+		offset, ok := annotationOffset(annotation)
+		if ok && (!canonical_ok || offset < canonical_offset) {
+			canonical, canonical_offset, canonical_ok = annotation, offset, true
+		}
+	}
+	return canonical
+}
+
+func termKey(annotation *AnnotationInfo) string {
+	if annotation.WikidataID != "" {
+		return annotation.WikidataID
+	}
+	return strings.ToLower(annotation.Term)
+}
+
+func groupByTerm(annotations []*AnnotationInfo) []*TermGroup {
+
+	groups := make([]*TermGroup, 0)
+	lookup := make(map[string]*TermGroup, 0)
+	for _, annotation := range annotations {
+		key := termKey(annotation)
+		group, ok := lookup[key]
+		if !ok {
+			group = &TermGroup{
+				Key:        key,
+				Term:       annotation.Term,
+				WikidataID: annotation.WikidataID,
+				Dictionary: annotation.Dictionary,
+			}
+			lookup[key] = group
+			groups = append(groups, group)
+		}
+		group.Annotations = append(group.Annotations, annotation)
+	}
+	return groups
+}
+
+func findTermGroup(groups []*TermGroup, key string) *TermGroup {
+	for _, group := range groups {
+		if group.Key == key {
+			return group
+		}
+	}
+	return nil
+}
+
+// Offsets come back from the query service as decimals, possibly with a leading +
+func annotationOffset(annotation *AnnotationInfo) (float64, bool) {
+	offset, err := strconv.ParseFloat(strings.TrimPrefix(annotation.Offset, "+"), 64)
+	return offset, err == nil
+}
+
+// Every pairing of a drug mention and a disease mention that are close enough together in the
+// text to support the claim
+func supportingPairs(drug *TermGroup, disease *TermGroup) []ClaimInfo {
+
+	pairs := make([]ClaimInfo, 0)
+	for _, drug_annotation := range drug.Annotations {
+		drug_offset, ok := annotationOffset(drug_annotation)
+		if !ok {
+			continue
+		}
+		for _, disease_annotation := range disease.Annotations {
+			disease_offset, ok := annotationOffset(disease_annotation)
+			if !ok {
+				continue
+			}
+			distance := drug_offset - disease_offset
+			if distance < 0 {
+				distance = -distance
+			}
+			if distance < EVIDENCE_DISTANCE {
+				pairs = append(pairs, ClaimInfo{Drug: drug_annotation, Disease: disease_annotation})
+			}
+		}
+	}
+	return pairs
+}
+
+func (ctx *ServerContext) TermReviewEnabled() bool {
+	return ctx.Configuration.PropertyMap[EVIDENCE_PROPERTY] != ""
+}
+
+// Records the claim with a reference for each supporting pair, pointing at the drug and disease
+// anchors, so it's clear which mentions go together. The wikibase library can only make a bare
+// claim, and adding each reference afterwards would be a call per pair and could leave a claim
+// half evidenced, so we set the whole statement at once with wbsetclaim.
+func (cw *claimWriter) RecordWithEvidence(drug_annotation *AnnotationInfo, disease_annotation *AnnotationInfo, pairs []ClaimInfo) error {
+
+	items := []string{string(drug_annotation.AnnotationID), string(disease_annotation.AnnotationID)}
+	return cw.audited("record_claim_with_evidence", items, func() error {
+
+		ctx := cw.ctx
+		claim_property := ctx.Configuration.PropertyMap[CLAIM_PROPERTY]
+		evidence_property := ctx.Configuration.PropertyMap[EVIDENCE_PROPERTY]
+
+		err := flaggedError(drug_annotation, disease_annotation)
+		if err != nil {
+			return err
+		}
+		err = cw.checkNotClaimed(drug_annotation, disease_annotation)
+		if err != nil {
+			return err
+		}
+
+		statement_id, err := newStatementID(string(drug_annotation.AnnotationID))
+		if err != nil {
+			return err
+		}
+		main_snak, err := itemSnak(claim_property, string(disease_annotation.AnnotationID))
+		if err != nil {
+			return err
+		}
+		statement := wikibaseStatement{
+			ID:         statement_id,
+			Type:       "statement",
+			MainSnak:   main_snak,
+			References: make([]wikibaseReference, 0, len(pairs)),
+			Rank:       "normal",
+		}
+		seen := make(map[string]bool, len(pairs))
+		for _, pair := range pairs {
+			key := string(pair.Drug.AnchorID) + "/" + string(pair.Disease.AnchorID)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+
+			reference := wikibaseReference{Snaks: make(map[string][]wikibaseSnak, 1)}
+			for _, anchor_id := range []string{string(pair.Drug.AnchorID), string(pair.Disease.AnchorID)} {
+				snak, err := itemSnak(evidence_property, anchor_id)
+				if err != nil {
+					return err
+				}
+				reference.Snaks[evidence_property] = append(reference.Snaks[evidence_property], snak)
+			}
+			statement.References = append(statement.References, reference)
+		}
+		claim_data, err := json.Marshal(statement)
+		if err != nil {
+			return err
+		}
+
+		form := url.Values{
+			"action": []string{"wbsetclaim"},
+			"claim":  []string{string(claim_data)},
+		}
+		summary := cw.editSummary(fmt.Sprintf("Recorded claim with %d evidence pairs", len(statement.References)), drug_annotation.Term, disease_annotation.Term)
+		return cw.callAPI("set_claim", summary, form, nil)
+	})
+}
+
+func termReviewHandler(ctx *ServerContext, w http.ResponseWriter, r *http.Request) {
+
+	// Should only be called by POST
+	if r.Method != "POST" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !ctx.TermReviewEnabled() {
+		ctx.renderError(w, notFoundError("Reviewing by term isn't available on this Science Source instance."))
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		ctx.renderError(w, badRequestError("We couldn't read the submitted form.", err))
+		return
+	}
+	drug_key := r.FormValue("drug_term")
+	disease_key := r.FormValue("disease_term")
+	confirm := r.FormValue("confirm")
+	confirm_duplicate := r.FormValue("confirm_duplicate")
+
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	article, annotations, _, err := ctx.getArticleAndAnnotations(id)
+	if err != nil {
+		ctx.renderError(w, err)
+		return
+	}
+
+	groups := groupByTerm(unflagged(annotations))
+	drug := findTermGroup(groups, drug_key)
+	disease := findTermGroup(groups, disease_key)
+	if drug == nil || disease == nil {
+		ctx.renderError(w, badRequestError("Please go back and select one drug term and one disease term from this article.",
+			fmt.Errorf("missing term info: drug %q disease %q", drug_key, disease_key)))
+		return
+	}
+
+	pairs := supportingPairs(drug, disease)
+	exact_duplicate, duplicates := findDuplicateClaims(annotations, drug.Canonical(), disease.Canonical())
+
+	if confirm == "true" && exact_duplicate {
+		ctx.renderError(w, conflictError(fmt.Sprintf("%s is already recorded as used in treatment of %s for this article.",
+			drug.Term, disease.Term)))
+		return
+	}
+
+	if confirm == "true" && (len(duplicates) == 0 || confirm_duplicate == "true") {
+		if ctx.AccessToken == nil {
+			ctx.renderError(w, unauthorisedError("You must be logged in to record a claim.", nil))
+			return
+		}
+		err = ctx.checkCSRF(r)
+		if err != nil {
+			ctx.renderError(w, err)
+			return
+		}
+
+		err = ctx.newClaimWriter(id).RecordWithEvidence(drug.Canonical(), disease.Canonical(), pairs)
+		if err != nil {
+			ctx.renderError(w, err)
+			return
+		}
+
+		http.Redirect(w, r, "../../", http.StatusSeeOther)
+		return
+	}
+
+	err = ctx.Templates.ExecuteWriter("term_review.html", pongo.Context{
+		"title":             article.Title,
+		"drug":              drug,
+		"disease":           disease,
+		"pairs":             pairs,
+		"evidence_distance": EVIDENCE_DISTANCE,
+		"exact_duplicate":   exact_duplicate,
+		"duplicates":        duplicates,
+		"ctx":               ctx,
+	}, w)
+	if err != nil {
+		ctx.renderError(w, err)
+	}
+}
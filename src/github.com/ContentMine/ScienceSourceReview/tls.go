@@ -0,0 +1,117 @@
+//   Copyright 2019 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+)
+
+type TLSConfig struct {
+	Certificate     string `json:"certificate"`
+	PrivateKey      string `json:"private_key"`
+	MinVersion      string `json:"min_version"`
+	RedirectAddress string `json:"redirect_address"`
+}
+
+var TLS_VERSIONS = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+const DEFAULT_TLS_MIN_VERSION = "1.2"
+
+func (config TLSConfig) Enabled() bool {
+	return config.Certificate != ""
+}
+
+// Holds the current certificate so it can be swapped out when renewed without restarting. New
+// connections pick up the new certificate, existing ones carry on with the old.
+type certificateStore struct {
+	CertificatePath string
+	PrivateKeyPath  string
+
+	lock        sync.RWMutex
+	certificate *tls.Certificate
+}
+
+func newCertificateStore(certificate_path string, private_key_path string) (*certificateStore, error) {
+	cs := certificateStore{
+		CertificatePath: certificate_path,
+		PrivateKeyPath:  private_key_path,
+	}
+	err := cs.reload()
+	if err != nil {
+		return nil, err
+	}
+	return &cs, nil
+}
+
+func (cs *certificateStore) reload() error {
+
+	certificate, err := tls.LoadX509KeyPair(cs.CertificatePath, cs.PrivateKeyPath)
+	if err != nil {
+		return err
+	}
+
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	cs.certificate = &certificate
+	return nil
+}
+
+func (cs *certificateStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cs.lock.RLock()
+	defer cs.lock.RUnlock()
+	return cs.certificate, nil
+}
+
+func (config TLSConfig) tlsConfig(cs *certificateStore) (*tls.Config, error) {
+
+	min_version := config.MinVersion
+	if min_version == "" {
+		min_version = DEFAULT_TLS_MIN_VERSION
+	}
+	version, ok := TLS_VERSIONS[min_version]
+	if !ok {
+		return nil, fmt.Errorf("unrecognised TLS minimum version %s", min_version)
+	}
+
+	return &tls.Config{
+		MinVersion:     version,
+		GetCertificate: cs.GetCertificate,
+	}, nil
+}
+
+// Sends plain HTTP requests to the same path over HTTPS on the given port
+func httpsRedirectHandler(https_port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		if https_port != "443" {
+			host = net.JoinHostPort(host, https_port)
+		}
+
+		target := "https://" + host + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+	})
+}
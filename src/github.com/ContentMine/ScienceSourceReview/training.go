@@ -0,0 +1,424 @@
+//   Copyright 2019 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	pongo "github.com/flosch/pongo2"
+	"github.com/gorilla/mux"
+)
+
+// Training mode lets new reviewers check their judgements against the experts'. Admins import a
+// gold standard: the drug/disease pairs that should be found in each of a set of articles. In
+// training mode writes go to the sandbox journal, kept apart from sandbox practice, and the
+// existing claims are hidden so trainees can't copy them. For gold standard articles they can see
+// how their picks score, and start the article again if they want another go.
+
+const TRAINING_SESSION_KEY = "training"
+
+const MAX_GOLD_FILE_SIZE = 1024 * 1024
+
+// Each side of a pair is either a Wikidata ID or a term, so the gold standard still applies if
+// the article is annotated again
+type goldPair struct {
+	Drug    string `json:"drug"`
+	Disease string `json:"disease"`
+}
+
+type goldArticle struct {
+	Article string     `json:"article"`
+	Pairs   []goldPair `json:"pairs"`
+}
+
+func goldTermMatches(value string, annotation *AnnotationInfo) bool {
+	if annotation.WikidataID != "" && value == annotation.WikidataID {
+		return true
+	}
+	return strings.EqualFold(value, annotation.Term)
+}
+
+func (p goldPair) Matches(drug *AnnotationInfo, disease *AnnotationInfo) bool {
+	return goldTermMatches(p.Drug, drug) && goldTermMatches(p.Disease, disease)
+}
+
+type goldStandard struct {
+	Path string
+
+	lock     sync.RWMutex
+	articles map[string][]goldPair
+}
+
+func parseGoldStandard(data []byte) (map[string][]goldPair, error) {
+
+	var list []goldArticle
+	err := json.Unmarshal(data, &list)
+	if err != nil {
+		return nil, err
+	}
+
+	articles := make(map[string][]goldPair, len(list))
+	for _, article := range list {
+		if !WIKIDATA_ID_PATTERN.MatchString(article.Article) {
+			return nil, fmt.Errorf("%q isn't an article item ID", article.Article)
+		}
+		if _, ok := articles[article.Article]; ok {
+			return nil, fmt.Errorf("article %s is listed more than once", article.Article)
+		}
+		if len(article.Pairs) == 0 {
+			return nil, fmt.Errorf("article %s has no pairs", article.Article)
+		}
+		for _, pair := range article.Pairs {
+			if strings.TrimSpace(pair.Drug) == "" || strings.TrimSpace(pair.Disease) == "" {
+				return nil, fmt.Errorf("article %s has a pair without both a drug and a disease", article.Article)
+			}
+		}
+		articles[article.Article] = article.Pairs
+	}
+	return articles, nil
+}
+
+// Loads the gold standard if there is one yet. With no path an imported gold standard is only
+// kept in memory.
+func newGoldStandard(path string) (*goldStandard, error) {
+
+	gold := &goldStandard{Path: path, articles: make(map[string][]goldPair, 0)}
+	if path == "" {
+		return gold, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return gold, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	gold.articles, err = parseGoldStandard(data)
+	if err != nil {
+		return nil, fmt.Errorf("gold standard %s: %v", path, err)
+	}
+	return gold, nil
+}
+
+// Replaces the whole gold standard with a newly imported one. The file is written alongside and
+// moved into place so we never leave a half written one behind.
+func (gs *goldStandard) Import(data []byte) error {
+
+	articles, err := parseGoldStandard(data)
+	if err != nil {
+		return err
+	}
+
+	gs.lock.Lock()
+	defer gs.lock.Unlock()
+
+	if gs.Path != "" {
+		temp_path := gs.Path + ".new"
+		err = ioutil.WriteFile(temp_path, data, 0600)
+		if err != nil {
+			return err
+		}
+		err = os.Rename(temp_path, gs.Path)
+		if err != nil {
+			return err
+		}
+	}
+
+	gs.articles = articles
+	return nil
+}
+
+func (gs *goldStandard) Pairs(article_id string) ([]goldPair, bool) {
+	gs.lock.RLock()
+	defer gs.lock.RUnlock()
+	pairs, ok := gs.articles[article_id]
+	return pairs, ok
+}
+
+func (gs *goldStandard) Has(article_id string) bool {
+	_, ok := gs.Pairs(article_id)
+	return ok
+}
+
+func (gs *goldStandard) Articles() []goldArticle {
+
+	gs.lock.RLock()
+	defer gs.lock.RUnlock()
+
+	res := make([]goldArticle, 0, len(gs.articles))
+	for article, pairs := range gs.articles {
+		res = append(res, goldArticle{Article: article, Pairs: pairs})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Article < res[j].Article })
+	return res
+}
+
+type trainingPick struct {
+	Drug    *AnnotationInfo
+	Disease *AnnotationInfo
+	Correct bool
+}
+
+// A gold standard pair, with the terms from the article where we can find them so we're not
+// just showing Wikidata IDs
+type goldResult struct {
+	Pair        goldPair
+	DrugTerm    string
+	DiseaseTerm string
+	Found       bool
+}
+
+type trainingScore struct {
+	Picks     []trainingPick
+	Gold      []goldResult
+	Correct   int
+	Found     int
+	Precision int
+	Recall    int
+}
+
+func percentage(n int, total int) int {
+	if total == 0 {
+		return 0
+	}
+	return (100*n + total/2) / total
+}
+
+// Compares the trainee's claims with the gold standard. In training mode the only claims on the
+// annotations are the ones from their current attempt at the article. Picks are compared at the
+// term level, so picking any mention of the right drug and disease counts, and picking the same
+// pair twice only counts once.
+func scoreTraining(annotations []*AnnotationInfo, gold []goldPair) trainingScore {
+
+	lookup := make(map[string]*AnnotationInfo, len(annotations))
+	for _, annotation := range annotations {
+		lookup[string(annotation.AnnotationID)] = annotation
+	}
+
+	var score trainingScore
+	seen := make(map[string]bool, 0)
+	for _, annotation := range annotations {
+		for _, claim := range annotation.Claims {
+			target, ok := lookup[string(claim)]
+			if !ok {
+				continue
+			}
+			drug, disease := annotation, target
+			if !isDrug(drug) && isDrug(disease) {
+				drug, disease = disease, drug
+			}
+			key := termKey(drug) + "|" + termKey(disease)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+
+			pick := trainingPick{Drug: drug, Disease: disease}
+			for _, pair := range gold {
+				if pair.Matches(drug, disease) {
+					pick.Correct = true
+					break
+				}
+			}
+			if pick.Correct {
+				score.Correct += 1
+			}
+			score.Picks = append(score.Picks, pick)
+		}
+	}
+
+	term := func(value string) string {
+		for _, annotation := range annotations {
+			if goldTermMatches(value, annotation) {
+				return annotation.Term
+			}
+		}
+		return value
+	}
+
+	for _, pair := range gold {
+		result := goldResult{Pair: pair, DrugTerm: term(pair.Drug), DiseaseTerm: term(pair.Disease)}
+		for _, pick := range score.Picks {
+			if pair.Matches(pick.Drug, pick.Disease) {
+				result.Found = true
+				break
+			}
+		}
+		if result.Found {
+			score.Found += 1
+		}
+		score.Gold = append(score.Gold, result)
+	}
+
+	score.Precision = percentage(score.Correct, len(score.Picks))
+	score.Recall = percentage(score.Found, len(gold))
+	return score
+}
+
+// Lists the gold standard articles, and lets a reviewer turn training mode on and off for their
+// session
+func trainingHandler(ctx *ServerContext, w http.ResponseWriter, r *http.Request) {
+
+	if r.Method == "POST" {
+		if ctx.AccessToken == nil {
+			ctx.renderError(w, unauthorisedError("You must be logged in to use training mode.", nil))
+			return
+		}
+		err := ctx.checkCSRF(r)
+		if err != nil {
+			ctx.renderError(w, err)
+			return
+		}
+
+		ctx.CookieSession.Values[TRAINING_SESSION_KEY] = r.FormValue("training") == "on"
+		err = ctx.CookieSession.Save(r, w)
+		if err != nil {
+			ctx.renderError(w, err)
+			return
+		}
+		http.Redirect(w, r, ".", http.StatusSeeOther)
+		return
+	}
+
+	all_articles, err := ctx.getArticleList()
+	if err != nil {
+		ctx.renderError(w, err)
+		return
+	}
+	articles := make([]ArticleInfo, 0)
+	for _, article := range all_articles {
+		if ctx.Gold.Has(string(article.ItemID)) {
+			articles = append(articles, article)
+		}
+	}
+
+	err = ctx.Templates.ExecuteWriter("training.html", pongo.Context{
+		"articles": articles,
+		"ctx":      ctx,
+	}, w)
+	if err != nil {
+		ctx.renderError(w, err)
+	}
+}
+
+func scoreHandler(ctx *ServerContext, w http.ResponseWriter, r *http.Request) {
+
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	if !ctx.Training {
+		ctx.renderError(w, badRequestError("Your answers are only scored in training mode.", nil))
+		return
+	}
+	gold, ok := ctx.Gold.Pairs(id)
+	if !ok {
+		ctx.renderError(w, notFoundError(fmt.Sprintf("Article %s isn't one of the training articles.", id)))
+		return
+	}
+
+	if r.Method == "POST" {
+		if ctx.AccessToken == nil || ctx.Username == "" {
+			ctx.renderError(w, unauthorisedError("You must be logged in to start an article again.", nil))
+			return
+		}
+		err := ctx.checkCSRF(r)
+		if err != nil {
+			ctx.renderError(w, err)
+			return
+		}
+		if r.FormValue("action") != "reset" {
+			ctx.renderError(w, badRequestError("We didn't understand what you wanted to do.", nil))
+			return
+		}
+		err = ctx.Journal.Reset(ctx, id)
+		if err != nil {
+			ctx.renderError(w, err)
+			return
+		}
+		http.Redirect(w, r, "../", http.StatusSeeOther)
+		return
+	}
+
+	article, annotations, _, err := ctx.getArticleAndAnnotations(id)
+	if err != nil {
+		ctx.renderError(w, err)
+		return
+	}
+
+	err = ctx.Templates.ExecuteWriter("score.html", pongo.Context{
+		"title": article.Title,
+		"score": scoreTraining(annotations, gold),
+		"ctx":   ctx,
+	}, w)
+	if err != nil {
+		ctx.renderError(w, err)
+	}
+}
+
+// Lets admins see and replace the gold standard
+func goldHandler(ctx *ServerContext, w http.ResponseWriter, r *http.Request) {
+
+	err := ctx.checkAdmin("You must be logged in as an administrator to manage the gold standard.")
+	if err != nil {
+		ctx.renderError(w, err)
+		return
+	}
+
+	if r.Method == "POST" {
+		r.Body = http.MaxBytesReader(w, r.Body, MAX_GOLD_FILE_SIZE)
+		err = ctx.checkCSRF(r)
+		if err != nil {
+			ctx.renderError(w, err)
+			return
+		}
+		file, _, err := r.FormFile("gold")
+		if err != nil {
+			ctx.renderError(w, badRequestError("Please choose a gold standard file to import.", err))
+			return
+		}
+		defer file.Close()
+		data, err := ioutil.ReadAll(file)
+		if err != nil {
+			ctx.renderError(w, badRequestError("We couldn't read the gold standard file.", err))
+			return
+		}
+
+		err = ctx.Gold.Import(data)
+		if err != nil {
+			ctx.renderError(w, badRequestError(fmt.Sprintf("We couldn't import the gold standard: %v", err), err))
+			return
+		}
+		ctx.Log("info", "Imported gold standard", logFields{"articles": len(ctx.Gold.Articles())})
+
+		http.Redirect(w, r, ".", http.StatusSeeOther)
+		return
+	}
+
+	err = ctx.Templates.ExecuteWriter("gold.html", pongo.Context{
+		"articles": ctx.Gold.Articles(),
+		"ctx":      ctx,
+	}, w)
+	if err != nil {
+		ctx.renderError(w, err)
+	}
+}
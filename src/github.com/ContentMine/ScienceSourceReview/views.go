@@ -17,7 +17,6 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 	"net/url"
 	"strings"
@@ -37,13 +36,14 @@ SELECT ?res ?page_ID ?article_text_title WHERE {
 `
 
 type ArticleInfo struct {
-	Title  string
-	PageID string
-	ItemID wikibase.ItemPropertyType
+	Title      string
+	PageID     string
+	ItemID     wikibase.ItemPropertyType
+	WikidataID string
 }
 
 const ANNOTATION_LIST_QUERY_SPARQL = `
-SELECT ?anchor ?annotation ?term ?dictionary ?Wikidata_item_code ?preceding_phrase ?following_phrase ?character_number ?claim WHERE {
+SELECT ?anchor ?annotation ?term ?dictionary ?Wikidata_item_code ?preceding_phrase ?following_phrase ?character_number ?claim ?flagged WHERE {
   ?anchor wdt:{anchorin} wd:%s.
   ?annotation wdt:{basedon} ?anchor.
   ?annotation wdt:{term} ?term.
@@ -53,14 +53,19 @@ SELECT ?anchor ?annotation ?term ?dictionary ?Wikidata_item_code ?preceding_phra
   OPTIONAL { ?anchor wdt:{preceding_phrase} ?preceding_phrase. }
   OPTIONAL { ?anchor wdt:{following_phrase} ?following_phrase. }
   OPTIONAL { ?annotation wdt:{claim} ?claim. }
+  {flag_clause}
 } ORDER BY ?term ASC(?character_number)
 `
 
+// Only goes in the annotation query if flagging is configured for this instance
+const ANNOTATION_FLAG_CLAUSE = "OPTIONAL { ?annotation wdt:{flagged} ?flagged. }"
+
 type AnnotationInfo struct {
 	AnchorID        wikibase.ItemPropertyType
 	AnchorRaw       string
 	AnnotationID    wikibase.ItemPropertyType
 	AnnotationRaw   string
+	ArticleID       wikibase.ItemPropertyType
 	Term            string
 	Dictionary      string
 	WikidataID      string
@@ -68,6 +73,9 @@ type AnnotationInfo struct {
 	FollowingPhrase string
 	Offset          string
 	Claims          []wikibase.ItemPropertyType
+	Flagged         bool
+	FlagReasons     []string
+	Sandbox         bool
 }
 type AnnotationSummaryInfo struct {
 	WikidataID string
@@ -128,10 +136,21 @@ const CLAIM_PROPERTY = "claim"
 const TITLE_PROPERTY = "title"
 const PAGE_ID_PROPERTY = "pageid"
 const WIKIDATA_ID_PROPERTY = "wikidataid"
+const INSTANCE_OF_PROPERTY = "instanceof"
+const ARTICLE_CLASS = "article"
 
 type ClaimInfo struct {
 	Drug    *AnnotationInfo
 	Disease *AnnotationInfo
+
+	// The claim was made on the disease annotation pointing at the drug
+	Reversed bool
+	// One end of the claim is an annotation in another article
+	External bool
+	// One end of the claim isn't an annotation we can find, in which case only one of Drug and
+	// Disease is set
+	Dangling   bool
+	DanglingID wikibase.ItemPropertyType
 }
 
 func (ctx *ServerContext) PrepareSPARQL(query string) string {
@@ -152,7 +171,7 @@ func (ctx *ServerContext) PrepareSPARQL(query string) string {
 func (ctx *ServerContext) getArticleList() ([]ArticleInfo, error) {
 
 	query := ctx.PrepareSPARQL(ARTICLE_LIST_QUERY_SPARQL)
-	resp, err := wikibase.MakeSPARQLQuery(ctx.Configuration.QueryServiceURL, query)
+	resp, err := ctx.querySPARQL("article_list", query)
 	if err != nil {
 		return nil, err
 	}
@@ -177,47 +196,90 @@ func homeHandler(ctx *ServerContext, w http.ResponseWriter, r *http.Request) {
 
 	res, err := ctx.getArticleList()
 	if err != nil {
-		log.Printf("Error making query: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		ctx.renderError(w, err)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-
-	t := pongo.Must(pongo.FromFile("templates/home.html"))
-	err = t.ExecuteWriter(pongo.Context{"articles": res, "ctx": ctx}, w)
+	err = ctx.Templates.ExecuteWriter("home.html", pongo.Context{"articles": res, "ctx": ctx}, w)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		ctx.renderError(w, err)
 	}
 }
 
-func (ctx *ServerContext) getArticleProperties(article_id string) (map[string]string, error) {
+// Returns all the values of each property on the item, keyed by the full property URL
+func (ctx *ServerContext) getArticleProperties(article_id string) (map[string][]string, error) {
 
 	query := ctx.PrepareSPARQL(GET_ITEM_PROPERTIES_SPARQL)
-
-	log.Printf("%v", fmt.Sprintf(query, article_id))
-
-	resp, err := wikibase.MakeSPARQLQuery(ctx.Configuration.QueryServiceURL, fmt.Sprintf(query, article_id))
+	resp, err := ctx.querySPARQL("item_properties", fmt.Sprintf(query, article_id))
 	if err != nil {
 		return nil, err
 	}
 
-	res := make(map[string]string, len(resp.Results.Bindings))
+	res := make(map[string][]string, len(resp.Results.Bindings))
 	for _, binding := range resp.Results.Bindings {
 		propUrl := binding["propUrl"].Value
 		value := binding["valUrl"].Value
 		if propUrl != "" && value != "" {
-			res[propUrl] = value
+			res[propUrl] = append(res[propUrl], value)
 		}
 	}
 
 	return res, nil
 }
 
+// Fetches the article's details, checking that the item exists and is actually an article, as
+// otherwise we'd render an empty page for any Q number someone cared to type in.
+func (ctx *ServerContext) getArticle(article_id string) (*ArticleInfo, error) {
+
+	properties, err := ctx.getArticleProperties(article_id)
+	if err != nil {
+		return nil, err
+	}
+
+	not_found := notFoundError(fmt.Sprintf("There is no article %s in Science Source.", article_id))
+	if len(properties) == 0 {
+		return nil, not_found
+	}
+
+	property := func(key string) []string {
+		return properties[ctx.Configuration.PropertyPrefix+ctx.Configuration.PropertyMap[key]]
+	}
+	first := func(key string) string {
+		if values := property(key); len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+
+	article_class := ctx.Configuration.EntityPrefix + ctx.Configuration.PropertyMap[ARTICLE_CLASS]
+	is_article := false
+	for _, class := range property(INSTANCE_OF_PROPERTY) {
+		if class == article_class {
+			is_article = true
+			break
+		}
+	}
+	if !is_article {
+		return nil, not_found
+	}
+
+	return &ArticleInfo{
+		Title:      first(TITLE_PROPERTY),
+		PageID:     first(PAGE_ID_PROPERTY),
+		ItemID:     wikibase.ItemPropertyType(article_id),
+		WikidataID: first(WIKIDATA_ID_PROPERTY),
+	}, nil
+}
+
 func (ctx *ServerContext) getArticleAnnotationList(article_id string) ([]*AnnotationInfo, map[string]AnnotationSummaryInfo, error) {
 
-	query := ctx.PrepareSPARQL(ANNOTATION_LIST_QUERY_SPARQL)
-	resp, err := wikibase.MakeSPARQLQuery(ctx.Configuration.QueryServiceURL, fmt.Sprintf(query, article_id))
+	flag_clause := ""
+	if ctx.FlaggingEnabled() {
+		flag_clause = ANNOTATION_FLAG_CLAUSE
+	}
+	query := strings.NewReplacer("{flag_clause}", flag_clause).Replace(ANNOTATION_LIST_QUERY_SPARQL)
+	query = ctx.PrepareSPARQL(query)
+	resp, err := ctx.querySPARQL("annotation_list", fmt.Sprintf(query, article_id))
 	if err != nil {
 		return nil, nil, err
 	}
@@ -266,52 +328,148 @@ func (ctx *ServerContext) getArticleAnnotationList(article_id string) ([]*Annota
 
 			summaries[term] = summary
 		}
+		// Optional values can repeat across rows, as we get a row for every combination of them
 		claim := binding["claim"].Value
 		if claim != "" {
-			annotation.Claims = append(annotation.Claims, wikibase.ItemPropertyType(strings.TrimPrefix(claim, ctx.Configuration.EntityPrefix)))
+			claim_id := wikibase.ItemPropertyType(strings.TrimPrefix(claim, ctx.Configuration.EntityPrefix))
+			if !containsItem(annotation.Claims, claim_id) {
+				annotation.Claims = append(annotation.Claims, claim_id)
+			}
+		}
+		if flagged, ok := binding["flagged"]; ok {
+			annotation.Flagged = true
+			if !containsString(annotation.FlagReasons, flagged.Value) {
+				annotation.FlagReasons = append(annotation.FlagReasons, flagged.Value)
+			}
 		}
 		previous_annotation = annotation
 
 	}
 
+	// Trainees shouldn't see the answers, so only their own claims are left
+	if ctx.Training {
+		for _, annotation := range annotations {
+			annotation.Claims = make([]wikibase.ItemPropertyType, 0)
+		}
+	}
+	if ctx.Sandbox {
+		annotations = ctx.applySandbox(article_id, annotations, summaries)
+	}
+
 	return annotations, summaries, nil
 }
 
+// The article details and its annotations come from separate queries that don't depend on each
+// other, so fetch them together
+func (ctx *ServerContext) getArticleAndAnnotations(article_id string) (*ArticleInfo, []*AnnotationInfo, map[string]AnnotationSummaryInfo, error) {
+
+	var article *ArticleInfo
+	var annotations []*AnnotationInfo
+	var summaries map[string]AnnotationSummaryInfo
+
+	err := ctx.fetchAll(
+		func(fetch_ctx *ServerContext) error {
+			var err error
+			article, err = fetch_ctx.getArticle(article_id)
+			return err
+		},
+		func(fetch_ctx *ServerContext) error {
+			var err error
+			annotations, summaries, err = fetch_ctx.getArticleAnnotationList(article_id)
+			return err
+		},
+	)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return article, annotations, summaries, nil
+}
+
+func containsItem(items []wikibase.ItemPropertyType, item wikibase.ItemPropertyType) bool {
+	for _, i := range items {
+		if i == item {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
 func articleHandler(ctx *ServerContext, w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 
-	properties, err := ctx.getArticleProperties(id)
+	// As well as the article and its annotations, we need any claims pointing in at the
+	// annotations from elsewhere
+	var article *ArticleInfo
+	var annotations []*AnnotationInfo
+	var summaries map[string]AnnotationSummaryInfo
+	var incoming []claimLink
+	err := ctx.fetchAll(
+		func(fetch_ctx *ServerContext) error {
+			var err error
+			article, err = fetch_ctx.getArticle(id)
+			return err
+		},
+		func(fetch_ctx *ServerContext) error {
+			var err error
+			annotations, summaries, err = fetch_ctx.getArticleAnnotationList(id)
+			return err
+		},
+		func(fetch_ctx *ServerContext) error {
+			if ctx.Training {
+				return nil
+			}
+			var err error
+			incoming, err = fetch_ctx.getIncomingClaims(id)
+			return err
+		},
+	)
 	if err != nil {
-		log.Printf("Error making property query: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		ctx.renderError(w, err)
 		return
 	}
 
-	title := properties[ctx.Configuration.PropertyPrefix+ctx.Configuration.PropertyMap[TITLE_PROPERTY]]
-	page_id := properties[ctx.Configuration.PropertyPrefix+ctx.Configuration.PropertyMap[PAGE_ID_PROPERTY]]
-	wikidata_id := properties[ctx.Configuration.PropertyPrefix+ctx.Configuration.PropertyMap[WIKIDATA_ID_PROPERTY]]
-
-	article_page_url := fmt.Sprintf("%s/?curid=%s", ctx.Configuration.WikibaseURL, page_id)
-	scisource_page_url := fmt.Sprintf("%s/wiki/item:%s", ctx.Configuration.WikibaseURL, id)
-	wikidata_page_url := fmt.Sprintf("https://wikidata.org/wiki/item:%s", wikidata_id)
-
-	annotations, summaries, err := ctx.getArticleAnnotationList(id)
+	claims, err := ctx.resolveClaims(id, annotations, incoming)
 	if err != nil {
-		log.Printf("Error making annotation query: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		ctx.renderError(w, err)
 		return
 	}
 
+	basket := ctx.getBasket(id).Resolve(annotations)
+
+	title := article.Title
+	article_page_url := fmt.Sprintf("%s/?curid=%s", ctx.Configuration.WikibaseURL, article.PageID)
+	scisource_page_url := fmt.Sprintf("%s/wiki/item:%s", ctx.Configuration.WikibaseURL, id)
+	wikidata_page_url := fmt.Sprintf("https://wikidata.org/wiki/item:%s", article.WikidataID)
+
 	// Can we extract the dictionary names?
 	disease_dictionary := ""
 	drug_dictionary := ""
 	graph_sparql := ""
 
 	// This is a bit of poor guesswork - in future the data model should support his better
+	// Flagged annotations are kept out of the review tables, but listed separately
 	drugs := make([]*AnnotationInfo, 0)
 	diseases := make([]*AnnotationInfo, 0)
+	flagged := make([]*AnnotationInfo, 0)
+	unflagged := make([]*AnnotationInfo, 0, len(annotations))
 	for _, annotation := range annotations {
+		if annotation.Flagged {
+			flagged = append(flagged, annotation)
+			continue
+		}
+		unflagged = append(unflagged, annotation)
+
 		dict := annotation.Dictionary
 		if strings.Contains(dict, "drug") {
 			drug_dictionary = dict
@@ -330,71 +488,152 @@ func articleHandler(ctx *ServerContext, w http.ResponseWriter, r *http.Request)
 		graph_sparql = fmt.Sprintf("%s%s", ctx.Configuration.QueryServiceEmbedURL, encoded)
 	}
 
-	// Generate a nice lookup set for checking viewews
-	set := make(map[wikibase.ItemPropertyType]*AnnotationInfo, 0)
-	for _, annotation := range annotations {
-		set[annotation.AnnotationID] = annotation
-	}
-	claims := make([]ClaimInfo, 0)
-	for _, annotation := range annotations {
-		for _, claim := range annotation.Claims {
-			new_claim := ClaimInfo{
-				Drug:    annotation,
-				Disease: set[claim],
-			}
-			claims = append(claims, new_claim)
+	drug_terms := make([]*TermGroup, 0)
+	disease_terms := make([]*TermGroup, 0)
+	for _, group := range groupByTerm(unflagged) {
+		if strings.Contains(group.Dictionary, "drug") {
+			drug_terms = append(drug_terms, group)
+		} else {
+			disease_terms = append(disease_terms, group)
 		}
 	}
 
-	w.WriteHeader(http.StatusOK)
-	t := pongo.Must(pongo.FromFile("templates/article.html"))
-	err = t.ExecuteWriter(pongo.Context{
+	err = ctx.Templates.ExecuteWriter("article.html", pongo.Context{
 		"summaries":          summaries,
 		"drugs":              drugs,
 		"diseases":           diseases,
+		"flagged":            flagged,
 		"title":              title,
 		"claims":             claims,
 		"article_page_url":   article_page_url,
 		"scisource_page_url": scisource_page_url,
 		"wikidata_page_url":  wikidata_page_url,
 		"graph_sparql":       graph_sparql,
+		"basket":             basket,
+		"drug_terms":         drug_terms,
+		"disease_terms":      disease_terms,
+		"max_basket_size":    MAX_BASKET_SIZE,
+		"training_article":   ctx.Training && ctx.Gold.Has(id),
 		"ctx":                ctx}, w)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		ctx.renderError(w, err)
 	}
 }
 
-func recordClaim(ctx *ServerContext, drug_annotation *AnnotationInfo, disease_annotation *AnnotationInfo) error {
+// Two annotations are about the same thing if they point at the same wikidata item, or failing
+// that if they're the same term
+func sameTerm(a *AnnotationInfo, b *AnnotationInfo) bool {
+	if a.WikidataID != "" && b.WikidataID != "" {
+		return a.WikidataID == b.WikidataID
+	}
+	return strings.EqualFold(a.Term, b.Term)
+}
 
-	access_token := wikibase.AccessToken{
-		Token:  ctx.AccessToken.Token,
-		Secret: ctx.AccessToken.Secret,
+// Looks for claims already made in this article that match the one being reviewed. An exact
+// duplicate is the same drug annotation already claimed against the same disease annotation,
+// which we never want to write twice. A term level duplicate is the same drug and disease
+// terms linked via different anchors, which might be deliberate, so we just ask the reviewer.
+// Claims made the wrong way round, from disease to drug, count too. This works from the query
+// service, so won't see claims made in the last few moments; the claim writer asks the wikibase
+// itself before writing, so exact duplicates are still caught then.
+func findDuplicateClaims(annotations []*AnnotationInfo, drug *AnnotationInfo, disease *AnnotationInfo) (bool, []ClaimInfo) {
+
+	for _, claim := range drug.Claims {
+		if claim == disease.AnnotationID {
+			return true, nil
+		}
 	}
-	oauth_info := wikibase.OAuthInformation{
-		Consumer: ctx.Configuration.OAuthConsumer,
-		Access:   &access_token,
+	for _, claim := range disease.Claims {
+		if claim == drug.AnnotationID {
+			return true, nil
+		}
 	}
-	oauth_client := wikibase.NewOAuthNetworkClient(oauth_info, ctx.Configuration.WikibaseURL)
-	wikibase_client := wikibase.NewClient(oauth_client)
 
-	// We will need an editing token
-	_, err := wikibase_client.GetEditingToken()
-	if err != nil {
-		return err
+	candidates := unflagged(annotations)
+	set := make(map[wikibase.ItemPropertyType]*AnnotationInfo, len(candidates))
+	for _, annotation := range candidates {
+		set[annotation.AnnotationID] = annotation
 	}
 
-	item_claim, err := wikibase.ItemClaimToAPIData(disease_annotation.AnnotationID)
-	if err != nil {
-		return err
+	duplicates := make([]ClaimInfo, 0)
+	for _, annotation := range candidates {
+		for _, claim := range annotation.Claims {
+			target, ok := set[claim]
+			if !ok {
+				continue
+			}
+			if sameTerm(annotation, drug) && sameTerm(target, disease) {
+				duplicates = append(duplicates, ClaimInfo{Drug: annotation, Disease: target})
+			} else if sameTerm(annotation, disease) && sameTerm(target, drug) {
+				duplicates = append(duplicates, ClaimInfo{Drug: target, Disease: annotation, Reversed: true})
+			}
+		}
 	}
-	item_data, err := json.Marshal(item_claim)
-	if err != nil {
-		return err
+
+	return false, duplicates
+}
+
+// Writes claims to the wikibase as the logged in reviewer. Getting an editing token is a round
+// trip of its own, so we get one with the first write and use it for every claim after that.
+// Each operation goes in the audit log, along with the calls it made.
+type claimWriter struct {
+	ctx     *ServerContext
+	token   string
+	article string
+	mode    string
+	calls   []auditCall
+}
+
+// The writer is for edits about a single article, which is mentioned in the edit summaries
+func (ctx *ServerContext) newClaimWriter(article_id string) *claimWriter {
+	mode := AUDIT_MODE_LIVE
+	if ctx.Training {
+		mode = AUDIT_MODE_TRAINING
+	} else if ctx.Sandbox {
+		mode = AUDIT_MODE_SANDBOX
 	}
+	return &claimWriter{ctx: ctx, article: article_id, mode: mode}
+}
+
+func (cw *claimWriter) Record(drug_annotation *AnnotationInfo, disease_annotation *AnnotationInfo) error {
+
+	items := []string{string(drug_annotation.AnnotationID), string(disease_annotation.AnnotationID)}
+	return cw.audited("record_claim", items, func() error {
+
+		err := flaggedError(drug_annotation, disease_annotation)
+		if err != nil {
+			return err
+		}
+		err = cw.checkNotClaimed(drug_annotation, disease_annotation)
+		if err != nil {
+			return err
+		}
+
+		// Built with our own snak rather than the library's, so that the item ID is always
+		// included, as sandbox items can't be identified by number alone
+		snak, err := itemSnak(cw.ctx.Configuration.PropertyMap[CLAIM_PROPERTY], string(disease_annotation.AnnotationID))
+		if err != nil {
+			return err
+		}
+		item_data, err := json.Marshal(snak.DataValue.Value)
+		if err != nil {
+			return err
+		}
 
-	_, err = wikibase_client.CreateClaimOnItem(drug_annotation.AnnotationID, ctx.Configuration.PropertyMap[CLAIM_PROPERTY], item_data)
+		form := url.Values{
+			"action":   []string{"wbcreateclaim"},
+			"entity":   []string{string(drug_annotation.AnnotationID)},
+			"property": []string{cw.ctx.Configuration.PropertyMap[CLAIM_PROPERTY]},
+			"snaktype": []string{"value"},
+			"value":    []string{string(item_data)},
+		}
+		summary := cw.editSummary("Recorded claim", drug_annotation.Term, disease_annotation.Term)
+		return cw.callAPI("create_claim", summary, form, nil)
+	})
+}
 
-	return err
+func recordClaim(ctx *ServerContext, article_id string, drug_annotation *AnnotationInfo, disease_annotation *AnnotationInfo) error {
+	return ctx.newClaimWriter(article_id).Record(drug_annotation, disease_annotation)
 }
 
 func reviewHandler(ctx *ServerContext, w http.ResponseWriter, r *http.Request) {
@@ -407,32 +646,24 @@ func reviewHandler(ctx *ServerContext, w http.ResponseWriter, r *http.Request) {
 
 	err := r.ParseForm()
 	if err != nil {
-		log.Printf("Error parsing form: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		ctx.renderError(w, badRequestError("We couldn't read the submitted form.", err))
 		return
 	}
 	drug_id := wikibase.ItemPropertyType(r.FormValue("drug"))
 	disease_id := wikibase.ItemPropertyType(r.FormValue("disease"))
 	confirm := r.FormValue("confirm")
+	confirm_duplicate := r.FormValue("confirm_duplicate")
 
 	vars := mux.Vars(r)
 	id := vars["id"]
 
-	properties, err := ctx.getArticleProperties(id)
+	article, annotations, _, err := ctx.getArticleAndAnnotations(id)
 	if err != nil {
-		log.Printf("Error making property query: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		ctx.renderError(w, err)
 		return
 	}
 
-	title := properties[TITLE_PROPERTY]
-
-	annotations, _, err := ctx.getArticleAnnotationList(id)
-	if err != nil {
-		log.Printf("Error making annotation query: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
+	title := article.Title
 
 	var drug_annotation *AnnotationInfo
 	var disease_annotation *AnnotationInfo
@@ -446,32 +677,56 @@ func reviewHandler(ctx *ServerContext, w http.ResponseWriter, r *http.Request) {
 	}
 
 	if drug_annotation == nil || disease_annotation == nil {
-		log.Printf("We have missing annotation info: %v %v", drug_id, disease_id)
-		http.Error(w, "Form data missing", http.StatusBadRequest)
+		ctx.renderError(w, badRequestError("Please go back and select one drug and one disease from this article.",
+			fmt.Errorf("missing annotation info: drug %q disease %q", drug_id, disease_id)))
+		return
+	}
+	exact_duplicate, duplicates := findDuplicateClaims(annotations, drug_annotation, disease_annotation)
+
+	if confirm == "true" && exact_duplicate {
+		ctx.renderError(w, conflictError(fmt.Sprintf("%s is already recorded as used in treatment of %s for these annotations.",
+			drug_annotation.Term, disease_annotation.Term)))
 		return
 	}
 
-	if confirm == "true" {
-		err := recordClaim(ctx, drug_annotation, disease_annotation)
+	// If they've not seen the term level duplicates yet, show them the review page again rather
+	// than writing
+	if confirm == "true" && (len(duplicates) == 0 || confirm_duplicate == "true") {
+		if ctx.AccessToken == nil {
+			ctx.renderError(w, unauthorisedError("You must be logged in to record a claim.", nil))
+			return
+		}
+		err = ctx.checkCSRF(r)
 		if err != nil {
-			log.Printf("Failed to record claim: %v", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			ctx.renderError(w, err)
 			return
 		}
 
-		http.Redirect(w, r, "../", http.StatusTemporaryRedirect)
+		err := recordClaim(ctx, id, drug_annotation, disease_annotation)
+		if err != nil {
+			ctx.renderError(w, err)
+			return
+		}
+
+		http.Redirect(w, r, "../", http.StatusSeeOther)
+		return
+	}
+
+	// Writing checks this itself, so that the rejection is audited
+	if err := flaggedError(drug_annotation, disease_annotation); err != nil {
+		ctx.renderError(w, err)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	t := pongo.Must(pongo.FromFile("templates/review.html"))
-	err = t.ExecuteWriter(pongo.Context{
-		"title":   title,
-		"drug":    drug_annotation,
-		"disease": disease_annotation,
-		"ctx":     ctx,
+	err = ctx.Templates.ExecuteWriter("review.html", pongo.Context{
+		"title":           title,
+		"drug":            drug_annotation,
+		"disease":         disease_annotation,
+		"exact_duplicate": exact_duplicate,
+		"duplicates":      duplicates,
+		"ctx":             ctx,
 	}, w)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		ctx.renderError(w, err)
 	}
 }
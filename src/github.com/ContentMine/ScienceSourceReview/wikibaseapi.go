@@ -0,0 +1,401 @@
+//   Copyright 2019 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// The wikibase library only covers making bare claims, and doesn't take a context, so we call the
+// wikibase API ourselves, signed with the reviewer's OAuth token. That way a call we give up on
+// is actually cancelled, rather than left running in the background.
+
+const WIKIBASE_API_URL = "%s/w/api.php"
+
+// Every edit we make carries a summary so patrollers can tell it came from here. Instances can
+// set their own with edit_summary, using the placeholders {action}, {article}, {terms}, {user}
+// and {version}.
+const DEFAULT_EDIT_SUMMARY = "{action} on {article} ({terms}) via ScienceSourceReview {version}"
+
+func (cw *claimWriter) editSummary(action string, terms ...string) string {
+
+	template := cw.ctx.Configuration.EditSummary
+	if template == "" {
+		template = DEFAULT_EDIT_SUMMARY
+	}
+	r := strings.NewReplacer(
+		"{action}", action,
+		"{article}", cw.article,
+		"{terms}", strings.Join(terms, ", "),
+		"{user}", cw.ctx.Username,
+		"{version}", Version,
+	)
+	return r.Replace(template)
+}
+
+type wikibaseEntityValue struct {
+	EntityType string `json:"entity-type"`
+	NumericID  int    `json:"numeric-id"`
+	ID         string `json:"id"`
+}
+
+type wikibaseQuantityValue struct {
+	Amount string `json:"amount"`
+	Unit   string `json:"unit"`
+}
+
+type wikibaseSnak struct {
+	SnakType  string `json:"snaktype"`
+	Property  string `json:"property"`
+	DataValue struct {
+		Type  string      `json:"type"`
+		Value interface{} `json:"value"`
+	} `json:"datavalue"`
+}
+
+type wikibaseReference struct {
+	Snaks map[string][]wikibaseSnak `json:"snaks"`
+}
+
+type wikibaseStatement struct {
+	ID         string                    `json:"id,omitempty"`
+	Type       string                    `json:"type"`
+	MainSnak   wikibaseSnak              `json:"mainsnak"`
+	Qualifiers map[string][]wikibaseSnak `json:"qualifiers,omitempty"`
+	References []wikibaseReference       `json:"references,omitempty"`
+	Rank       string                    `json:"rank"`
+}
+
+type wikibaseLabel struct {
+	Language string `json:"language"`
+	Value    string `json:"value"`
+}
+
+type wikibaseAPIError struct {
+	Code string `json:"code"`
+	Info string `json:"info"`
+}
+
+type wikibaseAPIResponse struct {
+	Success int               `json:"success"`
+	Error   *wikibaseAPIError `json:"error"`
+	Entity  *struct {
+		ID        string `json:"id"`
+		LastRevID int    `json:"lastrevid"`
+	} `json:"entity"`
+	PageInfo *struct {
+		LastRevID int `json:"lastrevid"`
+	} `json:"pageinfo"`
+}
+
+// The revision made by the edit, which depending on the action is in one of two places
+func (res *wikibaseAPIResponse) Revision() int {
+	if res.PageInfo != nil {
+		return res.PageInfo.LastRevID
+	}
+	if res.Entity != nil {
+		return res.Entity.LastRevID
+	}
+	return 0
+}
+
+func itemSnak(property string, item_id string) (wikibaseSnak, error) {
+
+	// Items made in the sandbox have their own prefix, but are otherwise like any other
+	var snak wikibaseSnak
+	numeric_id, err := strconv.Atoi(strings.TrimPrefix(strings.TrimPrefix(item_id, "Q"), SANDBOX_ID_PREFIX))
+	if err != nil {
+		return snak, fmt.Errorf("%q is not an item ID", item_id)
+	}
+	snak.SnakType = "value"
+	snak.Property = property
+	snak.DataValue.Type = "wikibase-entityid"
+	snak.DataValue.Value = wikibaseEntityValue{EntityType: "item", NumericID: numeric_id, ID: item_id}
+	return snak, nil
+}
+
+// Also used for external identifiers, which are strings as far as the API is concerned
+func stringSnak(property string, value string) wikibaseSnak {
+
+	var snak wikibaseSnak
+	snak.SnakType = "value"
+	snak.Property = property
+	snak.DataValue.Type = "string"
+	snak.DataValue.Value = value
+	return snak
+}
+
+func quantitySnak(property string, amount int) wikibaseSnak {
+
+	var snak wikibaseSnak
+	snak.SnakType = "value"
+	snak.Property = property
+	snak.DataValue.Type = "quantity"
+	snak.DataValue.Value = wikibaseQuantityValue{Amount: fmt.Sprintf("%+d", amount), Unit: "1"}
+	return snak
+}
+
+func newStatement(snak wikibaseSnak) wikibaseStatement {
+	return wikibaseStatement{Type: "statement", MainSnak: snak, Rank: "normal"}
+}
+
+// Statements set with wbsetclaim need us to make up their GUID
+func newStatementID(item_id string) (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%s$%x-%x-%x-%x-%x", item_id, b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
+// Makes a single call to the wikibase API and decodes the response into res
+func postWikibaseAPI(call_ctx context.Context, client *http.Client, wikibase_url string, form url.Values, res interface{}) error {
+
+	req, err := http.NewRequest("POST", fmt.Sprintf(WIKIBASE_API_URL, wikibase_url), strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := client.Do(req.WithContext(call_ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return &httpStatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	return json.NewDecoder(resp.Body).Decode(res)
+}
+
+type wikibaseTokenResponse struct {
+	Error *wikibaseAPIError `json:"error"`
+	Query struct {
+		Tokens struct {
+			CSRFToken string `json:"csrftoken"`
+		} `json:"tokens"`
+	} `json:"query"`
+}
+
+// Fetches an editing token for the reviewer. This is only a read, so unlike the edit itself is
+// safe to retry.
+func (ctx *ServerContext) getEditingToken() (string, error) {
+
+	client, err := ctx.OAuthConsumer.MakeHttpClient(ctx.AccessToken)
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"action": []string{"query"},
+		"meta":   []string{"tokens"},
+		"type":   []string{"csrf"},
+		"format": []string{"json"},
+	}
+
+	var token string
+	err = ctx.callUpstream("wikibase", "editing_token", true, func(call_ctx context.Context) error {
+		var res wikibaseTokenResponse
+		err := postWikibaseAPI(call_ctx, client, ctx.Configuration.WikibaseURL, form, &res)
+		if err != nil {
+			return err
+		}
+		if res.Error != nil {
+			return fmt.Errorf("token query failed: %s: %s", res.Error.Code, res.Error.Info)
+		}
+		if res.Query.Tokens.CSRFToken == "" {
+			return fmt.Errorf("token query did not return a token")
+		}
+		token = res.Query.Tokens.CSRFToken
+		return nil
+	})
+	return token, err
+}
+
+// Pulls the value out of a snak as a string, whatever its type
+func snakValue(snak wikibaseSnak) string {
+
+	switch value := snak.DataValue.Value.(type) {
+	case string:
+		return value
+	case map[string]interface{}:
+		if id, ok := value["id"].(string); ok && id != "" {
+			return id
+		}
+		if numeric_id, ok := value["numeric-id"].(float64); ok {
+			return fmt.Sprintf("Q%d", int(numeric_id))
+		}
+		if amount, ok := value["amount"].(string); ok {
+			return strings.TrimPrefix(amount, "+")
+		}
+	}
+	return ""
+}
+
+type wikibaseClaimsResponse struct {
+	Error  *wikibaseAPIError              `json:"error"`
+	Claims map[string][]wikibaseStatement `json:"claims"`
+}
+
+// Asks the wikibase itself whether the drug annotation already has a claim on the disease one.
+// The query service can be some way behind, so a reviewer submitting twice in quick succession
+// wouldn't be caught by findDuplicateClaims. In the sandbox the journal is always up to date, so
+// we don't need to ask.
+func (cw *claimWriter) checkNotClaimed(drug_annotation *AnnotationInfo, disease_annotation *AnnotationInfo) error {
+
+	ctx := cw.ctx
+	if ctx.Sandbox {
+		return nil
+	}
+
+	client, err := ctx.OAuthConsumer.MakeHttpClient(ctx.AccessToken)
+	if err != nil {
+		return err
+	}
+
+	property := ctx.Configuration.PropertyMap[CLAIM_PROPERTY]
+	form := url.Values{
+		"action":   []string{"wbgetclaims"},
+		"format":   []string{"json"},
+		"entity":   []string{string(drug_annotation.AnnotationID)},
+		"property": []string{property},
+	}
+
+	var res wikibaseClaimsResponse
+	err = ctx.callUpstream("wikibase", "get_claims", true, func(call_ctx context.Context) error {
+		res = wikibaseClaimsResponse{}
+		err := postWikibaseAPI(call_ctx, client, ctx.Configuration.WikibaseURL, form, &res)
+		if err != nil {
+			return err
+		}
+		if res.Error != nil {
+			return fmt.Errorf("wbgetclaims failed: %s: %s", res.Error.Code, res.Error.Info)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, statement := range res.Claims[property] {
+		if snakValue(statement.MainSnak) == string(disease_annotation.AnnotationID) {
+			return conflictError(fmt.Sprintf("%s is already recorded as used in treatment of %s for these annotations.",
+				drug_annotation.Term, disease_annotation.Term))
+		}
+	}
+	return nil
+}
+
+// POSTs an action to the wikibase API with our editing token, edit summary, and change tag if
+// the instance has one. These are all writes, so are never retried, and each is noted for the
+// audit log entry of the operation it's part of. If res is given the response is decoded into it
+// as well.
+func (cw *claimWriter) callAPI(call string, summary string, form url.Values, res *wikibaseAPIResponse) error {
+
+	if res == nil {
+		res = &wikibaseAPIResponse{}
+	}
+	err := cw.postAPI(call, summary, form, res)
+	cw.calls = append(cw.calls, newAuditCall(call, form, res, err))
+	return err
+}
+
+// The editing token is fetched with the first write, so that failing to get one is audited too.
+// Sandbox edits go in the journal instead, which is kept per reviewer, so we need to know who
+// they are.
+func (cw *claimWriter) postAPI(call string, summary string, form url.Values, res *wikibaseAPIResponse) error {
+
+	ctx := cw.ctx
+	form.Set("format", "json")
+	form.Set("summary", summary)
+	if ctx.Configuration.ChangeTag != "" {
+		form.Set("tags", ctx.Configuration.ChangeTag)
+	}
+	action := form.Get("action")
+
+	if ctx.Sandbox {
+		if ctx.Username == "" {
+			return unauthorisedError("We couldn't tell who you are, so can't keep your sandbox edits. Please log in again.", nil)
+		}
+		return ctx.Journal.Record(ctx, call, cw.article, form, res)
+	}
+
+	if cw.token == "" {
+		token, err := ctx.getEditingToken()
+		if err != nil {
+			return err
+		}
+		cw.token = token
+	}
+	form.Set("token", cw.token)
+
+	client, err := ctx.OAuthConsumer.MakeHttpClient(ctx.AccessToken)
+	if err != nil {
+		return err
+	}
+
+	return ctx.callUpstream("wikibase", call, false, func(call_ctx context.Context) error {
+		err := postWikibaseAPI(call_ctx, client, ctx.Configuration.WikibaseURL, form, res)
+		if err != nil {
+			return err
+		}
+		if res.Error != nil {
+			return fmt.Errorf("%s failed: %s: %s", action, res.Error.Code, res.Error.Info)
+		}
+		if res.Success != 1 {
+			return fmt.Errorf("%s did not report success", action)
+		}
+		return nil
+	})
+}
+
+// Makes a new item with an English label and the given statements, returning its ID
+func (cw *claimWriter) createItem(call string, label string, summary string, statements []wikibaseStatement) (string, error) {
+
+	data, err := json.Marshal(map[string]interface{}{
+		"labels": map[string]wikibaseLabel{"en": {Language: "en", Value: label}},
+		"claims": statements,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"action": []string{"wbeditentity"},
+		"new":    []string{"item"},
+		"data":   []string{string(data)},
+	}
+	var res wikibaseAPIResponse
+	err = cw.callAPI(call, summary, form, &res)
+	if err != nil {
+		return "", err
+	}
+	if res.Entity == nil || res.Entity.ID == "" {
+		return "", fmt.Errorf("wbeditentity did not return the new item ID")
+	}
+	return res.Entity.ID, nil
+}